@@ -1,12 +1,16 @@
 package client
 
 import (
+	"cmp"
 	"context"
+	"crypto/ecdh"
 	"errors"
 	"fmt"
 	"mediacenter/shared"
 	"net"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gen2brain/malgo"
@@ -15,170 +19,686 @@ import (
 
 // MediaClient is the media client
 type MediaClient struct {
-	serverPort int
+	serverPort     int
+	playbackDevice string
+	psk            string
+	authKey        string
+	mdns           bool
+	// serverHost is the server we connect straight to, instead
+	// of discovering one. Empty means we discover one
+	serverHost        string
+	discoveryFallback bool
+	// serverName is the name of the server we pick when more
+	// than one answers. Empty means we pick the first
+	serverName string
+	// transport is how we get packets to the server. tcpPort and
+	// webSocketPort are the server host's ports for the stream transports
+	transport     shared.Transport
+	tcpPort       int
+	webSocketPort int
 
 	name         string
-	capabilities []int
+	capabilities []shared.ClientCapability
+	// format is the format our devices run in
+	format shared.AudioFormat
+	// fecGroupSize is how many audio packets we'd like to send
+	// a parity packet for. It's 0 for no FEC
+	fecGroupSize int
+	// packetDuration is how much audio goes in each packet
+	packetDuration time.Duration
+
+	// session is the session we're streaming in. It's nil while
+	// we're finding the server, and the devices go quiet until it's back
+	session atomic.Pointer[activeSession]
+	state   atomic.Int32
+}
+
+// serverSession is what we know about our session with the server
+// once we've been identified
+type serverSession struct {
+	serverAddr net.Addr
+	// sessionToken is empty under a pre-shared key
+	sessionToken  string
+	sessionID     uint32
+	payloadFormat shared.PayloadFormat
+	// ciphers are nil when the session isn't encrypted
+	ciphers shared.SessionCiphers
+	// fecGroupSize is how many audio packets we send a parity
+	// packet for. It's 0 when the server didn't take FEC
+	fecGroupSize int
+}
+
+// activeSession is a session along with everything the
+// devices need to stream in it
+type activeSession struct {
+	serverSession
+	sender shared.AudioSender
+	// control authenticates our control messages and the server's. It's
+	// nil when the session isn't encrypted
+	control *shared.ControlAuth
+	// clock is the server's clock, synced over our heartbeats
+	clock *shared.ClockSync
+	// playbackCodec and playbackStream are nil if we don't play audio
+	playbackCodec  shared.Codec
+	playbackStream shared.AudioStream
 }
 
 // NewMediaClient creates a new media client
-func NewMediaClient(serverPort int, clientName string) *MediaClient {
-	// TODO - capabilities
+func NewMediaClient(options Options) *MediaClient {
+	capabilities := []shared.ClientCapability{shared.ClientCapabilityRecord}
+	if options.Playback {
+		capabilities = append(capabilities, shared.ClientCapabilityPlayback)
+	}
+
 	return &MediaClient{
-		serverPort: serverPort,
-		name:       clientName,
+		serverPort:     options.DiscoveryPort,
+		playbackDevice: options.PlaybackDevice,
+		psk:            options.PSK,
+		authKey:        options.AuthKey,
+		mdns:           options.MDNS,
+
+		serverHost:        options.ServerHost,
+		discoveryFallback: options.DiscoveryFallback,
+		serverName:        options.ServerName,
+		transport:         options.Transport,
+		tcpPort:           options.TCPPort,
+		webSocketPort:     options.WebSocketPort,
+		name:              options.Name,
+		capabilities:      capabilities,
+		format: shared.AudioFormat{
+			SampleRate: cmp.Or(options.SampleRate, shared.MixFormat.SampleRate),
+			Channels:   cmp.Or(options.Channels, shared.MixFormat.Channels),
+		},
+		fecGroupSize:   options.FECGroupSize,
+		packetDuration: options.PacketDuration,
 	}
 }
 
-// Start starts listening for audio and sending it to the server
+// Start starts listening for audio and sending it to the server. The devices
+// start right away, and the client connects to the server in the background,
+// reconnecting whenever it loses the server
 func (client *MediaClient) Start() (func() error, error) {
 	rootCtx := context.Background()
+	// the context lets us return from connecting early
+	// when we shut down
 	clientCtx, stopClient := context.WithCancel(rootCtx)
-	// the context is really only used during boot, to be able
-	// to return from server discovery early. So we can save ourselves
-	// some stopClient() calls by just deferring it here
-	defer stopClient()
 
-	connection, sessionToken, err := client.startUDP(clientCtx)
+	connection, err := client.listen()
 	if err != nil {
+		stopClient()
 		return nil, err
 	}
 
-	deviceCloser, err := shared.StartDevice("blackhole", malgo.Capture, func(_, pInput []byte, _ uint32) {
-		for packet := range shared.StreamSlice(pInput, shared.NetworkPacketSizeBytes) {
-			connection.Write(shared.CreateClientBytesRequest(sessionToken, packet))
+	captureCloser, err := shared.StartDevice("blackhole", malgo.Capture, client.format, func(_, pInput []byte, _ uint32) {
+		session := client.session.Load()
+		if session == nil {
+			return
+		}
+
+		for _, packet := range session.sender.Packetize(shared.BytesToFloats(pInput)) {
+			connection.WriteTo(packet, session.serverAddr)
 		}
 	})
 	if err != nil {
+		stopClient()
+		connection.Close()
 		return nil, err
 	}
 
+	playbackCloser := func() error { return nil }
+	if client.playback() {
+		playbackCloser, err = client.startPlayback()
+		if err != nil {
+			stopClient()
+			captureCloser()
+			connection.Close()
+			return nil, err
+		}
+	}
+	go client.run(clientCtx, connection)
+	go client.sendHeartbeats(clientCtx, connection)
+
 	closer := func() error {
-		deviceErr := deviceCloser()
+		stopClient()
+		captureErr := captureCloser()
+		client.sayGoodbye(connection)
+		playbackErr := playbackCloser()
 		connErr := connection.Close()
-		return multierr.Append(deviceErr, connErr)
+		return multierr.Combine(captureErr, playbackErr, connErr)
 	}
 
 	return closer, nil
 }
 
-func (client *MediaClient) discoverServer(ctx context.Context) (*net.UDPAddr, string, error) {
-	// set up a listener for server responses
-	listener, err := net.ListenPacket("udp", ":0")
+// sayGoodbye tells the server we're leaving, so it can let go of our
+// session right away instead of waiting for it to time out
+func (client *MediaClient) sayGoodbye(conn net.PacketConn) {
+	session := client.session.Swap(nil)
+	if session == nil {
+		return
+	}
+
+	conn.WriteTo(session.control.Craft(shared.GoodbyeKeyword, session.sessionID), session.serverAddr)
+}
+
+// playback tells you if we play the mix the server sends back
+func (client *MediaClient) playback() bool {
+	return slices.Contains(client.capabilities, shared.ClientCapabilityPlayback)
+}
+
+// startPlayback plays the mix the server sends back to us
+func (client *MediaClient) startPlayback() (func() error, error) {
+	deviceCloser, err := shared.StartDevice(client.playbackDevice, malgo.Playback, client.format, func(pOutput, _ []byte, _ uint32) {
+		session := client.session.Load()
+		if session == nil {
+			shared.ZeroSlice(pOutput)
+			return
+		}
+
+		session.playbackStream.ReadInto(shared.BytesToFloats(pOutput))
+	})
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
-	dst, err := net.ResolveUDPAddr("udp", fmt.Sprintf("255.255.255.255:%d", client.serverPort))
+	fmt.Println("Playing audio from server")
+	return deviceCloser, nil
+}
+
+// startSession sets up everything the devices need to stream in the
+// session, and makes it the session they stream in
+func (client *MediaClient) startSession(session serverSession) error {
+	codec, err := shared.NewCodec(session.payloadFormat, client.format.Channels)
 	if err != nil {
-		return nil, "", err
+		return err
+	}
+	packetFrames := shared.PacketFrames(codec, client.format, client.packetDuration)
+	if shared.PacketDurationCapped(codec, client.format, client.packetDuration) {
+		fmt.Printf(
+			"WARNING: %s of %s doesn't fit in a packet, sending %s per packet instead\n",
+			client.packetDuration,
+			codec.Format(),
+			shared.FramesDuration(packetFrames, client.format.SampleRate),
+		)
+	}
+	fmt.Printf(
+		"Sending audio as %s in %s, %s per packet\n",
+		codec.Format(),
+		client.format,
+		shared.FramesDuration(packetFrames, client.format.SampleRate),
+	)
+
+	active := &activeSession{
+		serverSession: session,
+		sender: shared.NewAudioSender(
+			codec,
+			session.ciphers.ToServer,
+			session.sessionID,
+			client.format,
+			client.packetDuration,
+		),
+		control: session.ciphers.ControlAuth(shared.AudioDirectionToServer),
+		clock:   shared.NewClockSync(),
+	}
+	if session.fecGroupSize > 0 {
+		fmt.Printf("Protecting audio with a parity packet every %d packets\n", session.fecGroupSize)
+		active.sender = shared.NewFECSender(active.sender, session.ciphers.ToServer, session.fecGroupSize)
+	}
+	if client.playback() {
+		active.playbackCodec, err = shared.NewCodec(session.payloadFormat, client.format.Channels)
+		if err != nil {
+			return err
+		}
+		// the mix is stamped with when to play it, so every room plays it at once
+		active.playbackStream = shared.NewSyncedStream(
+			shared.NewAudioStream(client.format.Channels, client.format.SampleRate),
+			client.format,
+			active.clock,
+		)
+	}
+
+	client.session.Store(active)
+	client.setState(ConnectionStateStreaming)
+	return nil
+}
+
+// handleAudio plays an audio packet from the server. It's false if the
+// packet wasn't audio from the server for our session
+func (client *MediaClient) handleAudio(packet []byte, session *activeSession) bool {
+	if session.playbackStream == nil {
+		return false
+	}
+
+	var err error
+	if session.ciphers.ToClient != nil {
+		packet, err = session.ciphers.ToClient.Open(packet)
+		if err != nil {
+			return false
+		}
+	}
+
+	header, payload, err := shared.DecodeAudioPacket(packet)
+	if err != nil || header.SessionID != session.sessionID {
+		return false
+	}
+
+	samples, err := session.playbackCodec.Decode(payload)
+	if err != nil {
+		fmt.Printf("error decoding audio from server: %s\n", err.Error())
+		return true
+	}
+	session.playbackStream.Push(header, samples, time.Now())
+	return true
+}
+
+// discoverServer finds the server and identifies with it. If we have a server host,
+// we go straight to it, and only fall back to discovery if we're allowed to
+func (client *MediaClient) discoverServer(ctx context.Context, listener net.PacketConn) (serverSession, error) {
+	// streams only ever go to the server host
+	if stream, ok := listener.(*shared.StreamConn); ok {
+		return client.findServer(ctx, listener, streamAddrs(stream))
+	}
+	if client.serverHost == "" {
+		return client.findServer(ctx, listener, client.discoveryAddrs)
+	}
+
+	session, err := client.findServer(ctx, listener, client.serverHostAddrs)
+	if err == nil || !client.discoveryFallback || shared.ShouldKillCtx(ctx) {
+		return session, err
+	}
+
+	fmt.Printf("could not connect to %s, falling back to discovery: %s\n", client.serverHost, err.Error())
+	return client.findServer(ctx, listener, client.discoveryAddrs)
+}
+
+// discoveryAddrs are the addresses we look for servers on when we don't know where they are
+func (client *MediaClient) discoveryAddrs(ctx context.Context) []net.Addr {
+	dsts := shared.DiscoveryAddrs(client.serverPort)
+	if client.mdns {
+		dsts = append(dsts, client.browseMDNS(ctx)...)
+	}
+
+	return shared.Map(dsts, func(dst *net.UDPAddr) net.Addr { return dst })
+}
+
+// serverHostAddrs is the address of our server host. It's looked up every
+// time, in case the host's address changes
+func (client *MediaClient) serverHostAddrs(_ context.Context) []net.Addr {
+	dst, err := net.ResolveUDPAddr("udp", hostWithPort(client.serverHost, client.serverPort))
+	if err != nil {
+		fmt.Printf("error looking up %s: %s\n", client.serverHost, err.Error())
+		return nil
+	}
+
+	return []net.Addr{dst}
+}
+
+// discoveredServer is a server that answered our discovery request
+type discoveredServer struct {
+	// addr is where the server takes identification
+	addr     net.Addr
+	response shared.DiscoveryResponse
+}
+
+func (server discoveredServer) String() string {
+	return fmt.Sprintf("%s (%s) at %s", server.response.Name, server.response.ID, server.addr.String())
+}
+
+// audioAddr is where the server takes our audio. Over UDP, that's the port it
+// told us about. Streams carry everything, so it's the stream
+func (server discoveredServer) audioAddr() net.Addr {
+	addr, ok := server.addr.(*net.UDPAddr)
+	if !ok {
+		return server.addr
+	}
+
+	return &net.UDPAddr{
+		IP:   addr.IP,
+		Port: server.response.Port,
+		Zone: addr.Zone,
+	}
+}
+
+// findServer sends discovery requests to the addresses dsts gives back, picks
+// a server out of the ones that answer, and identifies with it. Everything goes
+// through listener, so the server sees the same address we later send audio from
+func (client *MediaClient) findServer(
+	ctx context.Context,
+	listener net.PacketConn,
+	dsts func(ctx context.Context) []net.Addr,
+) (serverSession, error) {
+	var err error
+	var keyExchangeKey *ecdh.PrivateKey
+	if client.psk != "" {
+		keyExchangeKey, err = shared.GenerateKeyExchangeKey()
+		if err != nil {
+			return serverSession{}, err
+		}
+	}
+
+	for attempts := 1; ; attempts++ {
+		servers, err := client.collectServers(ctx, listener, dsts)
+		if err != nil {
+			return serverSession{}, err
+		}
+
+		server, ok := client.pickServer(servers)
+		if ok {
+			session, err := client.identifyWith(ctx, listener, server, keyExchangeKey)
+			if !errors.Is(err, errIdentificationTimeout) {
+				return session, err
+			}
+			fmt.Printf("%s didn't answer our identification\n", server)
+		}
+
+		if attempts >= ServerDiscoveryAttempts {
+			return serverSession{}, errors.New("could not find server")
+		}
 	}
+}
+
+// collectServers sends out discovery requests and collects every server that
+// answers within the discovery timeout
+func (client *MediaClient) collectServers(
+	ctx context.Context,
+	listener net.PacketConn,
+	dsts func(ctx context.Context) []net.Addr,
+) ([]discoveredServer, error) {
+	discoveryRequest := shared.CraftServerDiscoveryRequest(shared.SupportedProtocolVersions)
+	client.setState(ConnectionStateDiscovering)
+	fmt.Printf("Sending message to server: %s\n", discoveryRequest)
+	for _, dst := range dsts(ctx) {
+		listener.WriteTo(discoveryRequest, dst)
+	}
+	listener.SetReadDeadline(time.Now().Add(ServerDiscoveryTimeout))
 
-	attempts := 0
+	var servers []discoveredServer
+	buffer := make([]byte, 1024)
 	for {
 		if shared.ShouldKillCtx(ctx) {
-			return nil, "", nil
+			return nil, ctx.Err()
+		}
+
+		bytesReceived, peerAddr, err := listener.ReadFrom(buffer)
+		if err != nil {
+			return servers, nil
 		}
 
-		attempts++
-		fmt.Printf("Sending message to server: %s\n", shared.ServerDiscoveryKeyword)
-		listener.WriteTo([]byte(shared.ServerDiscoveryKeyword), dst)
-		listener.SetDeadline(time.Now().Add(ServerDiscoveryTimeout))
-		buffer := make([]byte, 1024)
-		var serverPort int
+		message := string(buffer[:bytesReceived])
+		fmt.Printf("received response from %s: %s\n", peerAddr.String(), message)
+		server, ok := client.handleDiscoveryResponse(message, peerAddr)
+		if !ok {
+			continue
+		}
 
-		for {
-			if shared.ShouldKillCtx(ctx) {
-				return nil, "", nil
+		// servers can answer more than once, over IPv4 and IPv6
+		duplicate := slices.ContainsFunc(servers, func(other discoveredServer) bool {
+			if server.response.ID == "" {
+				return other.addr.String() == server.addr.String()
 			}
+			return other.response.ID == server.response.ID
+		})
+		if !duplicate {
+			servers = append(servers, server)
+		}
+	}
+}
 
-			_, peerAddr, err := listener.ReadFrom(buffer)
-			if err != nil {
-				break
+// pickServer picks the server we identify with. If we have a server name, it's
+// the server by that name, otherwise it's whichever answered first
+func (client *MediaClient) pickServer(servers []discoveredServer) (discoveredServer, bool) {
+	if client.serverName != "" {
+		for _, server := range servers {
+			if strings.EqualFold(server.response.Name, client.serverName) {
+				return server, true
 			}
+		}
 
-			bufferContents := strings.TrimRight(string(buffer), "\x00")
-			shared.ZeroSlice(buffer)
+		fmt.Printf("didn't find a server named %s, found %d others:\n", client.serverName, len(servers))
+		for _, server := range servers {
+			fmt.Printf("\t%s\n", server)
+		}
+		return discoveredServer{}, false
+	}
 
-			peerUDPAddr, ok := peerAddr.(*net.UDPAddr)
-			if !ok {
-				continue
-			}
+	if len(servers) == 0 {
+		return discoveredServer{}, false
+	}
+	if len(servers) > 1 {
+		fmt.Printf("found %d servers, picking %s. Set server_name to pick another:\n", len(servers), servers[0])
+		for _, server := range servers {
+			fmt.Printf("\t%s\n", server)
+		}
+	}
+
+	return servers[0], true
+}
+
+// identifyWith identifies with the server we picked, answering its auth
+// challenge if it sends one
+func (client *MediaClient) identifyWith(
+	ctx context.Context,
+	listener net.PacketConn,
+	server discoveredServer,
+	keyExchangeKey *ecdh.PrivateKey,
+) (serverSession, error) {
+	client.setState(ConnectionStateIdentifying)
+	_, err := listener.WriteTo(shared.CraftClientIdentificationMessage(client.identification(keyExchangeKey)), server.addr)
+	if err != nil {
+		return serverSession{}, err
+	}
+	listener.SetReadDeadline(time.Now().Add(ServerDiscoveryTimeout))
 
-			fmt.Printf("received response from %s: %s\n", peerAddr.String(), bufferContents)
-			actionType := shared.IdentifyServerAction(bufferContents)
-
-			switch actionType {
-			case shared.ServerActionDiscover:
-				var ok bool
-				ok, serverPort, err = client.handleDiscoveryResponse(bufferContents, peerUDPAddr, listener)
-				if !ok || err != nil {
-					continue
-				}
-			case shared.ServerActionIdentification:
-				ok, sessionToken, err := client.handleIdentificationResponse(bufferContents)
-				if err != nil {
-					serverPort = 0
-					break
-				}
-				if ok {
-					peerUDPAddr.Port = serverPort
-					return peerUDPAddr, sessionToken, nil
-				}
-			default:
-				fmt.Println("unknown action")
+	buffer := make([]byte, 1024)
+	for {
+		if shared.ShouldKillCtx(ctx) {
+			return serverSession{}, ctx.Err()
+		}
+
+		bytesReceived, peerAddr, err := listener.ReadFrom(buffer)
+		if err != nil {
+			return serverSession{}, errIdentificationTimeout
+		}
+		// other servers can still be answering our discovery request
+		if peerAddr.String() != server.addr.String() {
+			continue
+		}
+
+		message := string(buffer[:bytesReceived])
+		fmt.Printf("received response from %s: %s\n", peerAddr.String(), message)
+		if shared.IdentifyServerAction(message) != shared.ServerActionIdentification {
+			continue
+		}
+
+		isChallenge, err := client.handleAuthChallenge(message, peerAddr, listener, keyExchangeKey)
+		if isChallenge {
+			if err != nil {
+				return serverSession{}, err
 			}
+			listener.SetReadDeadline(time.Now().Add(ServerDiscoveryTimeout))
+			continue
 		}
 
-		if attempts >= ServerDiscoveryAttempts {
-			return nil, "", errors.New("could not find server")
+		ok, result, err := client.handleIdentificationResponse(message)
+		if err != nil {
+			return serverSession{}, err
+		}
+		if !ok {
+			continue
 		}
+
+		ciphers, err := client.deriveCiphers(keyExchangeKey, result)
+		if err != nil {
+			return serverSession{}, err
+		}
+
+		fmt.Printf("Identified with %s\n", server)
+		return serverSession{
+			serverAddr:    server.audioAddr(),
+			sessionToken:  result.SessionToken,
+			sessionID:     result.SessionID,
+			payloadFormat: result.PayloadFormat,
+			ciphers:       ciphers,
+			fecGroupSize:  result.FECGroupSize,
+		}, nil
 	}
 }
 
-func (client *MediaClient) handleDiscoveryResponse(message string, dst *net.UDPAddr, conn net.PacketConn) (bool, int, error) {
-	isServer, serverPort, err := shared.ReadServerDiscoveryResponse(message)
-	if err != nil {
-		return false, 0, err
+// handleDiscoveryResponse reads a server's answer to our discovery request. It
+// returns false if it wasn't one, or if the server won't take us
+func (client *MediaClient) handleDiscoveryResponse(message string, peerAddr net.Addr) (discoveredServer, bool) {
+	isServer, response, err := shared.ReadServerDiscoveryResponse(message)
+	if !isServer || err != nil {
+		return discoveredServer{}, false
+	}
+	if response.Reason != "" {
+		fmt.Printf(
+			"server at %s refused us: %s (it speaks protocol versions %s, we speak %s)\n",
+			peerAddr.String(),
+			response.Reason,
+			response.ProtocolVersions,
+			shared.SupportedProtocolVersions,
+		)
+		return discoveredServer{}, false
 	}
+	if !shared.SupportedProtocolVersions.Contains(response.ProtocolVersion) {
+		fmt.Printf(
+			"server at %s picked protocol version %d, we speak %s\n",
+			peerAddr.String(),
+			response.ProtocolVersion,
+			shared.SupportedProtocolVersions,
+		)
+		return discoveredServer{}, false
+	}
+
+	return discoveredServer{addr: peerAddr, response: response}, true
+}
 
-	if !isServer {
-		return false, 0, nil
+// handleAuthChallenge answers the server's auth challenge by identifying again,
+// this time with the challenge signed. It returns whether this was a challenge
+func (client *MediaClient) handleAuthChallenge(
+	message string,
+	dst net.Addr,
+	conn net.PacketConn,
+	keyExchangeKey *ecdh.PrivateKey,
+) (bool, error) {
+	isChallenge, challenge, err := shared.ReadAuthChallenge(message)
+	if !isChallenge || err != nil {
+		return isChallenge, err
+	}
+	if client.authKey == "" {
+		return true, errors.New("server requires authentication but we don't have an auth key")
 	}
 
-	_, err = conn.WriteTo(shared.CraftClientIdentificationMessage(client.name, []int{1}), dst)
-	if err != nil {
-		return false, 0, err
+	identification := client.identification(keyExchangeKey)
+	identification.AuthChallenge = challenge
+	identification.AuthSignature = shared.SignAuthChallenge(client.authKey, challenge, identification)
+
+	_, err = conn.WriteTo(shared.CraftClientIdentificationMessage(identification), dst)
+	return true, err
+}
+
+// identification is what we tell the server about ourselves
+func (client *MediaClient) identification(keyExchangeKey *ecdh.PrivateKey) shared.ClientIdentification {
+	identification := shared.ClientIdentification{
+		Name:             client.name,
+		Capabilities:     client.capabilities,
+		PayloadFormats:   shared.SupportedPayloadFormats,
+		ProtocolVersions: shared.SupportedProtocolVersions,
+		AudioFormat:      client.format,
+		FECGroupSize:     client.fecGroupSize,
+	}
+	if keyExchangeKey != nil {
+		identification.PublicKey = keyExchangeKey.PublicKey().Bytes()
 	}
 
-	return true, serverPort, nil
+	return identification
 }
 
-func (client *MediaClient) handleIdentificationResponse(message string) (bool, string, error) {
-	ok, sessionToken, err := shared.ReadClientIdentificationResponse(message)
+func (client *MediaClient) handleIdentificationResponse(message string) (bool, shared.IdentificationResult, error) {
+	result, err := shared.ReadClientIdentificationResponse(message)
 	if err == shared.ErrNotClientIdentificationMessage {
-		return false, "", nil
+		return false, shared.IdentificationResult{}, nil
 	}
 	if err != nil {
-		return false, "", err
+		return false, shared.IdentificationResult{}, err
 	}
-	if !ok {
-		return false, "", errors.New("connection error")
+	if !result.OK && result.Reason == shared.RejectionReasonUnsupportedVersion {
+		return false, shared.IdentificationResult{}, fmt.Errorf(
+			"server rejected us: %s (it speaks protocol versions %s, we speak %s)",
+			result.Reason,
+			result.ProtocolVersions,
+			shared.SupportedProtocolVersions,
+		)
+	}
+	if !result.OK {
+		return false, shared.IdentificationResult{}, fmt.Errorf("server rejected us: %s", result.Reason)
+	}
+	if !shared.SupportedProtocolVersions.Contains(result.ProtocolVersion) {
+		return false, shared.IdentificationResult{}, fmt.Errorf(
+			"server picked protocol version %d, we speak %s",
+			result.ProtocolVersion,
+			shared.SupportedProtocolVersions,
+		)
+	}
+
+	return true, result, nil
+}
+
+// deriveCiphers finishes the session key exchange. If we have a pre-shared key,
+// we refuse to carry on with a server that didn't do the exchange
+func (client *MediaClient) deriveCiphers(
+	keyExchangeKey *ecdh.PrivateKey,
+	result shared.IdentificationResult,
+) (shared.SessionCiphers, error) {
+	if keyExchangeKey == nil {
+		return shared.SessionCiphers{}, nil
+	}
+	if len(result.PublicKey) == 0 {
+		return shared.SessionCiphers{}, errors.New("server doesn't support encryption")
+	}
+
+	ciphers, err := shared.DeriveSessionCiphers(keyExchangeKey, result.PublicKey, client.psk)
+	if err != nil {
+		return shared.SessionCiphers{}, err
 	}
 
-	return true, sessionToken, nil
+	err = shared.ConfirmSessionCiphers(ciphers, result.KeyConfirmation)
+	if err != nil {
+		return shared.SessionCiphers{}, err
+	}
+
+	return ciphers, nil
 }
 
-func (client *MediaClient) startUDP(ctx context.Context) (*net.UDPConn, string, error) {
-	serverAddr, sessionToken, err := client.discoverServer(ctx)
+// identify finds the server, identifies with it, and starts streaming in the new session
+func (client *MediaClient) identify(ctx context.Context, conn net.PacketConn) error {
+	session, err := client.discoverServer(ctx, conn)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
 
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	// clear the deadline discovery left behind
+	err = conn.SetDeadline(time.Time{})
 	if err != nil {
-		return nil, "", err
+		return err
+	}
+
+	return client.startSession(session)
+}
+
+// ListServers lists every server that answers discovery, without identifying with any
+func (client *MediaClient) ListServers() ([]string, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	servers, err := client.collectServers(context.Background(), conn, client.discoveryAddrs)
+	if err != nil {
+		return nil, err
 	}
 
-	return conn, sessionToken, nil
+	return shared.Map(servers, discoveredServer.String), nil
 }
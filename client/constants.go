@@ -1,6 +1,9 @@
 package client
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 const (
 	// ServerDiscoveryTimeout is the amount of time we wait
@@ -9,4 +12,22 @@ const (
 	// ServerDiscoveryAttempts is the number of time we'll try
 	// contacting the server before giving up
 	ServerDiscoveryAttempts = 3
+	// ReconnectMinDelay is how long we wait before trying to connect
+	// to the server again the first time it doesn't work
+	ReconnectMinDelay = time.Millisecond * 500
+	// ReconnectMaxDelay is the most we'll wait between tries
+	// at connecting to the server
+	ReconnectMaxDelay = time.Second * 30
+	// HeartbeatInterval is how often we let the server know we're
+	// still around, whether or not we're sending audio
+	HeartbeatInterval = time.Second
+	// ServerTimeout is how long we go without hearing from the
+	// server before we consider it gone
+	ServerTimeout = time.Second * 5
+	// MDNSBrowseTimeout is how long we wait for servers
+	// to answer an mDNS query
+	MDNSBrowseTimeout = time.Second
 )
+
+// errIdentificationTimeout is returned when the server we picked doesn't answer our identification
+var errIdentificationTimeout = errors.New("server didn't answer our identification")
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"mediacenter/shared"
+	"net"
+	"time"
+)
+
+// browseMDNS looks for servers advertised over mDNS, and gives back the addresses
+// to send them discovery requests on. It asks with a one-shot query, so it doesn't
+// need the mDNS port to itself
+func (client *MediaClient) browseMDNS(ctx context.Context) []*net.UDPAddr {
+	query, err := shared.CraftMDNSQuery()
+	if err != nil {
+		return nil
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		fmt.Printf("error browsing for servers over mDNS: %s\n", err.Error())
+		return nil
+	}
+	defer conn.Close()
+
+	conn.WriteToUDP(query, &net.UDPAddr{IP: net.ParseIP(shared.MDNSGroupIPv4), Port: shared.MDNSPort})
+	for _, ifi := range shared.MulticastInterfaces() {
+		conn.WriteToUDP(query, &net.UDPAddr{
+			IP:   net.ParseIP(shared.MDNSGroupIPv6),
+			Port: shared.MDNSPort,
+			Zone: ifi.Name,
+		})
+	}
+	conn.SetDeadline(time.Now().Add(MDNSBrowseTimeout))
+
+	seen := make(map[string]bool)
+	var addrs []*net.UDPAddr
+	buffer := make([]byte, 9000)
+	for {
+		if shared.ShouldKillCtx(ctx) {
+			return addrs
+		}
+
+		bytesReceived, src, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return addrs
+		}
+
+		services, err := shared.ReadMDNSServices(buffer[:bytesReceived])
+		if err != nil {
+			continue
+		}
+		for _, service := range services {
+			if _, ok := shared.PickProtocolVersion(shared.SupportedProtocolVersions, service.ProtocolVersions); !ok {
+				fmt.Printf(
+					"skipping %s from mDNS: it speaks protocol versions %s, we speak %s\n",
+					service.Name,
+					service.ProtocolVersions,
+					shared.SupportedProtocolVersions,
+				)
+				continue
+			}
+
+			// the server answered from the address we can reach it on
+			addr := &net.UDPAddr{IP: src.IP, Port: service.DiscoveryPort, Zone: src.Zone}
+			if seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+
+			fmt.Printf("found %s at %s over mDNS\n", service.Name, addr.String())
+			addrs = append(addrs, addr)
+		}
+	}
+}
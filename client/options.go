@@ -0,0 +1,58 @@
+package client
+
+import (
+	"mediacenter/shared"
+	"time"
+)
+
+// Options are the options for a media client
+type Options struct {
+	// DiscoveryPort is the port servers listen for discovery on
+	DiscoveryPort int
+	// Name is the name the client identifies with
+	Name string
+	// Playback is whether the client plays the mix the server sends back
+	Playback bool
+	// PlaybackDevice is the name of the device to play the mix out of.
+	// An empty name plays out of the default device
+	PlaybackDevice string
+	// PSK is the pre-shared key. When it's set, the client does a key
+	// exchange during identification and encrypts all of its audio
+	PSK string
+	// AuthKey is the key the client signs the server's auth challenges with
+	AuthKey string
+	// MDNS is whether the client also browses for servers over mDNS
+	MDNS bool
+	// ServerHost is the server to connect straight to, as a host name or IP,
+	// with an optional port. The port defaults to DiscoveryPort. Empty means
+	// the client discovers a server instead
+	ServerHost string
+	// DiscoveryFallback is whether the client falls back to discovering a
+	// server when it can't connect to ServerHost
+	DiscoveryFallback bool
+	// ServerName is the name of the server to pick when more than one
+	// answers discovery. Empty means the client picks the first to answer
+	ServerName string
+	// Transport is how the client gets packets to the server. It defaults
+	// to UDP. TCP and WebSockets are for networks that block UDP, and
+	// only connect to ServerHost
+	Transport shared.Transport
+	// TCPPort is the server host's TCP port, unless ServerHost has a port
+	TCPPort int
+	// WebSocketPort is the server host's WebSocket port, unless ServerHost has a port
+	WebSocketPort int
+	// SampleRate is the sample rate the client's devices run at. The
+	// server converts to and from its own. 0 means the mix's sample rate
+	SampleRate int
+	// Channels is the channel count the client's devices run with.
+	// 0 means the mix's channel count
+	Channels int
+	// FECGroupSize is how many audio packets the client sends a parity
+	// packet for, so the server can rebuild one lost packet out of each
+	// group. 0 turns FEC off
+	FECGroupSize int
+	// PacketDuration is how much audio goes in each packet, whatever the
+	// device's period is. 0 means shared.DefaultPacketDuration. It's capped
+	// to what fits in a packet, see shared.PacketFrames
+	PacketDuration time.Duration
+}
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mediacenter/shared"
+	"net"
+	"strconv"
+	"time"
+)
+
+// receive handles everything the server sends us during the session. It stops on
+// its own once the connection gets closed
+func (client *MediaClient) receive(ctx context.Context, conn net.PacketConn) {
+	buffer := make([]byte, shared.MaxAudioPacketLen)
+	lastHeard := time.Now()
+	for {
+		if shared.ShouldKillCtx(ctx) {
+			return
+		}
+
+		// the server answers our heartbeats, so hearing nothing
+		// at all for long enough means it's gone
+		if time.Since(lastHeard) > ServerTimeout {
+			fmt.Println("Server stopped answering, looking for it again")
+			client.reconnect(ctx, conn)
+			lastHeard = time.Now()
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(HeartbeatInterval))
+		bytesReceived, peerAddr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		session := client.session.Load()
+		// nobody but the server gets to talk to us
+		if session == nil || peerAddr.String() != session.serverAddr.String() {
+			continue
+		}
+
+		// only what really came from the server counts as hearing from
+		// it, or anyone spoofing its address could keep us hanging on
+		packet := buffer[:bytesReceived]
+		if shared.IsAudioPacket(packet) {
+			if client.handleAudio(packet, session) {
+				lastHeard = time.Now()
+			}
+			continue
+		}
+
+		err = client.handleControlMessage(ctx, string(packet), conn, session)
+		if errors.Is(err, errNotFromServer) {
+			continue
+		}
+		lastHeard = time.Now()
+		if err != nil {
+			fmt.Printf("error handling control message from server: %s\n", err.Error())
+		}
+	}
+}
+
+// errNotFromServer is returned for messages that can't be shown to be from the
+// server in our session. Under a pre-shared key, that's every control message
+// that isn't authenticated, or that we've already taken
+var errNotFromServer = errors.New("message isn't from the server")
+
+// handleControlMessage handles the control messages the server sends us
+func (client *MediaClient) handleControlMessage(
+	ctx context.Context,
+	message string,
+	conn net.PacketConn,
+	session *activeSession,
+) error {
+	control, err := shared.ReadControlMessage(message)
+	if err != nil || control.SessionID != session.sessionID || !session.control.Verify(message) {
+		return errNotFromServer
+	}
+
+	switch control.Keyword {
+	case shared.SessionRebindRequiredKeyword:
+		return client.rebind(control, conn, session)
+	case shared.SessionReidentifyKeyword:
+		// under a pre-shared key this has been verified like everything
+		// else, so nobody can knock us off the server by spoofing it
+		fmt.Printf("Server dropped our session: %s\n", control.Items[shared.ControlReasonKey])
+		client.reconnect(ctx, conn)
+		return nil
+	case shared.HeartbeatAckKeyword:
+		// the receiver notes that we heard from the server
+		return client.syncClock(control, session)
+	case shared.PingKeyword:
+		return client.pong(control, conn, session)
+	default:
+		return nil
+	}
+}
+
+// rebind proves to the server that we own our session. The server asks for this when
+// our audio shows up from an address it doesn't expect, usually because a NAT
+// gave us a new port
+func (client *MediaClient) rebind(control shared.ControlMessage, conn net.PacketConn, session *activeSession) error {
+	addr := control.Items[shared.ControlAddrKey]
+	counter := time.Now().UnixNano()
+	proof := shared.SignRebind(session.control.RebindKey(session.sessionToken), session.sessionID, addr, counter)
+	fmt.Printf("Server sees us at %s, rebinding our session\n", addr)
+
+	_, err := conn.WriteTo(session.control.Craft(
+		shared.SessionRebindKeyword,
+		session.sessionID,
+		shared.ControlAddrKey, addr,
+		shared.ControlCounterKey, strconv.FormatInt(counter, 10),
+		shared.ControlProofKey, shared.EncodeControlBytes(proof),
+	), session.serverAddr)
+	return err
+}
+
+// pong answers the server's ping, so it can measure our link. We echo back when
+// it sent the ping, and tell it when we got it
+func (client *MediaClient) pong(control shared.ControlMessage, conn net.PacketConn, session *activeSession) error {
+	_, err := conn.WriteTo(session.control.Craft(
+		shared.PongKeyword,
+		session.sessionID,
+		shared.ControlSentKey, control.Items[shared.ControlSentKey],
+		shared.ControlReceivedKey, shared.EncodeControlTime(time.Now()),
+	), session.serverAddr)
+	return err
+}
+
+// syncClock syncs our clock to the server's from its answer to our heartbeat.
+// Servers from before clock sync don't send the times, so there's nothing to sync
+func (client *MediaClient) syncClock(control shared.ControlMessage, session *activeSession) error {
+	now := time.Now()
+	if _, ok := control.Items[shared.ControlTransmitKey]; !ok {
+		return nil
+	}
+
+	sent, err := control.Time(shared.ControlSentKey)
+	if err != nil {
+		return err
+	}
+	received, err := control.Time(shared.ControlReceivedKey)
+	if err != nil {
+		return err
+	}
+	transmitted, err := control.Time(shared.ControlTransmitKey)
+	if err != nil {
+		return err
+	}
+
+	session.clock.AddSample(sent, received, transmitted, now)
+	return nil
+}
+
+// sendHeartbeats lets the server know we're still around until we shut down. The
+// server's answers are also how we sync our clock to its
+func (client *MediaClient) sendHeartbeats(ctx context.Context, conn net.PacketConn) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		session := client.session.Load()
+		if session == nil {
+			continue
+		}
+		conn.WriteTo(session.control.Craft(
+			shared.HeartbeatKeyword,
+			session.sessionID,
+			shared.ControlSentKey, shared.EncodeControlTime(time.Now()),
+		), session.serverAddr)
+	}
+}
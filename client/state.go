@@ -0,0 +1,99 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"mediacenter/shared"
+	"net"
+	"time"
+)
+
+// ConnectionState is where the client is in its connection to the server
+type ConnectionState int32
+
+const (
+	// ConnectionStateDiscovering is when the client is looking for servers
+	ConnectionStateDiscovering ConnectionState = iota
+	// ConnectionStateIdentifying is when the client is identifying with the server it picked
+	ConnectionStateIdentifying
+	// ConnectionStateStreaming is when the client has a session and is streaming audio
+	ConnectionStateStreaming
+	// ConnectionStateReconnecting is when the client lost the server, or couldn't
+	// connect, and is waiting to try again
+	ConnectionStateReconnecting
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case ConnectionStateDiscovering:
+		return "discovering"
+	case ConnectionStateIdentifying:
+		return "identifying"
+	case ConnectionStateStreaming:
+		return "streaming"
+	case ConnectionStateReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns where the client is in its connection to the server
+func (client *MediaClient) State() ConnectionState {
+	return ConnectionState(client.state.Load())
+}
+
+func (client *MediaClient) setState(state ConnectionState) {
+	previous := ConnectionState(client.state.Swap(int32(state)))
+	if previous != state {
+		fmt.Printf("Connection state: %s -> %s\n", previous, state)
+	}
+}
+
+// run connects to the server and streams until we shut down
+func (client *MediaClient) run(ctx context.Context, conn net.PacketConn) {
+	if !client.connect(ctx, conn) {
+		return
+	}
+	client.receive(ctx, conn)
+}
+
+// reconnect drops the session we lost and connects to the server again. The
+// devices keep running, they just go quiet until we have a new session
+func (client *MediaClient) reconnect(ctx context.Context, conn net.PacketConn) {
+	client.session.Store(nil)
+	client.setState(ConnectionStateReconnecting)
+	client.connect(ctx, conn)
+}
+
+// connect keeps trying to find the server and identify with it, backing off
+// exponentially between tries, until it works or we're shutting down. It returns
+// false if we're shutting down. We're the only ones reading from conn while this
+// runs, so discovery gets all the server's responses
+func (client *MediaClient) connect(ctx context.Context, conn net.PacketConn) bool {
+	delay := ReconnectMinDelay
+	for {
+		err := client.identify(ctx, conn)
+		if err == nil {
+			return true
+		}
+		if shared.ShouldKillCtx(ctx) || errors.Is(err, net.ErrClosed) {
+			return false
+		}
+
+		client.setState(ConnectionStateReconnecting)
+		// a bit of jitter keeps a room full of clients from
+		// all coming back at the same time
+		wait := delay + rand.N(delay/5)
+		fmt.Printf("error connecting to the server, trying again in %s: %s\n", wait.Round(time.Millisecond), err.Error())
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+
+		delay = min(delay*2, ReconnectMaxDelay)
+	}
+}
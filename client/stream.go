@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"mediacenter/shared"
+	"net"
+
+	"golang.org/x/net/websocket"
+)
+
+// listen opens the connection everything between us and the server goes through.
+// Over UDP that's a socket, over TCP and WebSockets it's a stream to the server
+// host that redials whenever it breaks
+func (client *MediaClient) listen() (net.PacketConn, error) {
+	switch client.transport {
+	case "", shared.TransportUDP:
+		return net.ListenUDP("udp", &net.UDPAddr{})
+	case shared.TransportTCP, shared.TransportWebSocket:
+	default:
+		return nil, fmt.Errorf("unknown transport %s", client.transport)
+	}
+
+	if client.serverHost == "" {
+		return nil, fmt.Errorf("the %s transport needs a server host to connect to", client.transport)
+	}
+
+	if client.transport == shared.TransportTCP {
+		host := hostWithPort(client.serverHost, client.tcpPort)
+		return shared.DialStreamConn(shared.StreamAddr{Transport: shared.TransportTCP, Addr: host}, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", host, ServerDiscoveryTimeout)
+		}), nil
+	}
+
+	host := hostWithPort(client.serverHost, client.webSocketPort)
+	return shared.DialStreamConn(shared.StreamAddr{Transport: shared.TransportWebSocket, Addr: host}, func() (net.Conn, error) {
+		return dialWebSocket(host)
+	}), nil
+}
+
+// dialWebSocket opens a WebSocket to the server at host
+func dialWebSocket(host string) (net.Conn, error) {
+	config, err := websocket.NewConfig(fmt.Sprintf("ws://%s%s", host, shared.WebSocketPath), fmt.Sprintf("http://%s", host))
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: ServerDiscoveryTimeout}
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	return ws, nil
+}
+
+// streamAddrs is the server on the other end of our stream. Everything we
+// write goes to it, whatever address we write to
+func streamAddrs(conn *shared.StreamConn) func(ctx context.Context) []net.Addr {
+	return func(_ context.Context) []net.Addr {
+		return []net.Addr{conn.RemoteAddr()}
+	}
+}
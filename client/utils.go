@@ -0,0 +1,18 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostWithPort adds the default port to a host that doesn't have one. Hosts
+// can be host names, IPv4 addresses, or IPv6 addresses, with or without brackets
+func hostWithPort(host string, defaultPort int) string {
+	_, _, err := net.SplitHostPort(host)
+	if err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(defaultPort))
+}
@@ -7,55 +7,119 @@ import (
 	"mediacenter/shared"
 	"net"
 	"slices"
+	"sync/atomic"
 	"time"
 )
 
 // ClientManager managers client connections
 type ClientManager interface {
+	// AddClient creates a new session for a client that identified itself
 	AddClient(
-		name string,
+		identification shared.ClientIdentification,
 		clientAddr net.Addr,
-		capabilities []int,
+		options SessionOptions,
 	) (Client, error)
 	SetClient(client Client)
 	// GetClientBySessionToken gets a client by their session token
 	GetClientBySessionToken(sessionToken string) (Client, bool)
+	// GetClientBySessionID gets a client by the compact session ID
+	// carried in their audio packets
+	GetClientBySessionID(sessionID uint32) (Client, bool)
 	// ConnectedClients returns a slice of the currently
 	// connected clients
 	ConnectedClients() []Client
+	// PlaybackClients returns a slice of the currently connected
+	// clients that play audio
+	PlaybackClients() []Client
+	// DisconnectClient marks a client that left as disconnected and frees
+	// its slot right away. It returns the client as it was when it left
+	DisconnectClient(sessionID uint32) (Client, bool)
 	// PrintStatuses prints the status of each client
 	PrintStatuses()
+	// OnSessionEnd has fn called with the session ID of every session that
+	// times out, so anything kept for the session elsewhere can go with it
+	OnSessionEnd(fn func(sessionID uint32))
 }
 
 type clientManager struct {
 	// clients is a map of client name to data
-	clients    shared.ThreadSafeMap[string, Client]
-	cleanIters int
+	clients shared.ThreadSafeMap[string, Client]
+	// sessionIDs is a map of session ID to session token
+	sessionIDs    shared.ThreadSafeMap[uint32, string]
+	lastSessionID atomic.Uint32
+	cleanIters    int
+	// onSessionEnd is called by the cleaner when it ends a
+	// session. It's nil until someone asks to be told
+	onSessionEnd atomic.Pointer[func(sessionID uint32)]
 }
 
 // NewClientManager creates a new client manager
 func NewClientManager(ctx context.Context) ClientManager {
 	manager := &clientManager{
-		clients: shared.NewThreadSafeMap[string, Client](MaxConnections),
+		clients:    shared.NewThreadSafeMap[string, Client](MaxConnections),
+		sessionIDs: shared.NewThreadSafeMap[uint32, string](0),
 	}
 	manager.startCleaner(ctx)
 	return manager
 }
 
 func (cm *clientManager) AddClient(
-	name string,
+	identification shared.ClientIdentification,
 	clientAddr net.Addr,
-	capabilities []int,
+	options SessionOptions,
 ) (Client, error) {
 	// For right now, there isn't really any data that we need to carry
 	// over between client connections, so there isn't any reason to check
 	// if the client already exists. Even if we have an already-connected
 	// client, it's more likely the client lost connection and is re-joining.
 	// So we just create a whole new client every time and save it
+	format := identification.AudioFormat
+	codec, err := shared.NewCodec(options.PayloadFormat, format.Channels)
+	if err != nil {
+		return Client{}, err
+	}
+
 	sessionToken := GenerateUUID()
-	client := NewClient(name, clientAddr, capabilities, sessionToken)
+	sessionID := cm.lastSessionID.Add(1)
+
+	// Decoding is stateless but encoding isn't, so the mix going back
+	// to the client gets its own codec
+	var sender shared.AudioSender
+	if identification.HasCapability(shared.ClientCapabilityPlayback) {
+		encoder, err := shared.NewCodec(options.PayloadFormat, format.Channels)
+		if err != nil {
+			return Client{}, err
+		}
+		sender = shared.NewAudioSender(encoder, options.Cipher, sessionID, format, options.PacketDuration)
+		if shared.PacketDurationCapped(encoder, format, options.PacketDuration) {
+			fmt.Printf(
+				"WARNING: %s of %s doesn't fit in a packet, sending %s %s per packet instead\n",
+				options.PacketDuration,
+				encoder.Format(),
+				identification.Name,
+				shared.FramesDuration(shared.PacketFrames(encoder, format, options.PacketDuration), format.SampleRate),
+			)
+		}
+	}
 
-	err := cm.clients.Set(sessionToken, client)
+	client := NewClient(identification, clientAddr, sessionToken, sessionID, codec, sender)
+	if sender != nil {
+		client.MixConverter = shared.NewFormatConverter(shared.MixFormat, format)
+	}
+	client.ProtocolVersion = options.ProtocolVersion
+	client.Control = options.Control
+	client.Identity = options.Identity
+	// a client that's identifying again keeps its place in the mix, as
+	// long as it's proven it's the same client. Names alone are anyone's
+	if previous, ok := cm.clientByIdentity(client.Identity); ok {
+		client.Mix = NewMixSettings(previous.Mix.State())
+	}
+	if options.FECGroupSize > 0 {
+		client.FECGroupSize = options.FECGroupSize
+		client.FEC = shared.NewFECDecoder()
+	}
+
+	err = cm.clients.Set(sessionToken, client)
 	if err == shared.ErrMapFull {
 		// If our connection map is full, try forcing cleaning out any
 		// disconnected clients
@@ -65,10 +129,27 @@ func (cm *clientManager) AddClient(
 	if err != nil {
 		return Client{}, err
 	}
+	cm.sessionIDs.Set(sessionID, sessionToken)
 
 	return client, nil
 }
 
+// clientByIdentity finds the client with that identity we heard from last
+func (cm *clientManager) clientByIdentity(identity string) (Client, bool) {
+	var found Client
+	ok := false
+	if identity == "" {
+		return found, ok
+	}
+	for _, client := range cm.clients.Snapshot() {
+		if client.Identity == identity && (!ok || client.LastSeen.After(found.LastSeen)) {
+			found = client
+			ok = true
+		}
+	}
+	return found, ok
+}
+
 // SetClient sets the client
 func (cm *clientManager) SetClient(client Client) {
 	cm.clients.Set(client.SessionToken, client)
@@ -80,6 +161,15 @@ func (cm *clientManager) GetClientBySessionToken(sessionToken string) (Client, b
 	return cm.clients.Get(sessionToken)
 }
 
+func (cm *clientManager) GetClientBySessionID(sessionID uint32) (Client, bool) {
+	sessionToken, ok := cm.sessionIDs.Get(sessionID)
+	if !ok {
+		return Client{}, false
+	}
+
+	return cm.clients.Get(sessionToken)
+}
+
 func (cm *clientManager) ConnectedClients() []Client {
 	snap := cm.clients.Snapshot()
 	return shared.FilterSlice(
@@ -88,6 +178,31 @@ func (cm *clientManager) ConnectedClients() []Client {
 	)
 }
 
+func (cm *clientManager) PlaybackClients() []Client {
+	return shared.FilterSlice(cm.ConnectedClients(), func(client Client) bool {
+		return slices.Contains(client.Capabilities, shared.ClientCapabilityPlayback)
+	})
+}
+
+func (cm *clientManager) DisconnectClient(sessionID uint32) (Client, bool) {
+	client, ok := cm.GetClientBySessionID(sessionID)
+	if !ok {
+		return Client{}, false
+	}
+
+	now := time.Now()
+	client.DisconnectedAt = &now
+	client.Status = ClientStatusDisconnected
+	cm.clients.Remove(client.SessionToken)
+	cm.sessionIDs.Remove(client.SessionID)
+
+	return client, true
+}
+
+func (cm *clientManager) OnSessionEnd(fn func(sessionID uint32)) {
+	cm.onSessionEnd.Store(&fn)
+}
+
 func (cm *clientManager) Message(name, msg string) error {
 	// TODO
 	return nil
@@ -105,9 +220,29 @@ func (cm *clientManager) PrintStatuses() {
 		fmt.Println("\n==========")
 		fmt.Println(time.Now().String())
 		fmt.Printf("%d connected clients:\n", nConnectedClients)
-		fmt.Println("\tClient name - Client status - Session token - Last seen")
+		fmt.Println("\tClient name - Client status - Session token - Audio format - Mix - Last seen - Lost packets - Loss events - Drift (ppm) - RTT - Jitter - Loss rate - Reorder rate - FEC recovered - FEC unrecoverable - Address mismatches")
 		for _, client := range clients {
-			fmt.Printf("\t%s - %s - %s - %s\n", client.Name, client.Status, client.SessionToken, client.LastSeen.String())
+			stats := client.Stream.Stats()
+			fec := client.FEC.Stats()
+			fmt.Printf(
+				"\t%s - %s - %s - %s - %s - %s - %d - %d - %.1f - %s - %s - %.2f%% - %.2f%% - %d - %d - %d\n",
+				client.Name,
+				client.Status,
+				client.SessionToken,
+				client.AudioFormat,
+				client.Mix.State(),
+				client.LastSeen.String(),
+				stats.Lost,
+				stats.LossEvents,
+				stats.DriftPPM,
+				client.Network.RTT.Round(time.Microsecond),
+				client.Network.Jitter.Round(time.Microsecond),
+				client.Network.LossRate*100,
+				client.Network.ReorderRate*100,
+				fec.Recovered,
+				fec.Unrecoverable,
+				client.AddrMismatches,
+			)
 		}
 		fmt.Println("==========")
 	}()
@@ -144,9 +279,13 @@ func (cm *clientManager) cleanConnections(forceClean bool) {
 			client.DisconnectedAt = &now
 			client.Status = ClientStatusDisconnected
 			cm.SetClient(client)
+			if onSessionEnd := cm.onSessionEnd.Load(); onSessionEnd != nil {
+				(*onSessionEnd)(client.SessionID)
+			}
 		}
 		if forceClean && client.Status == ClientStatusDisconnected {
-			cm.clients.Remove(client.Name)
+			cm.clients.Remove(client.SessionToken)
+			cm.sessionIDs.Remove(client.SessionID)
 		}
 	}
 }
@@ -10,12 +10,73 @@ import (
 type Client struct {
 	Name           string `json:"name"`
 	SessionToken   string
+	SessionID      uint32
 	Addr           *net.Addr
 	Status         ClientStatus
-	DataBuffer     shared.ThreadSafeBuffer[byte]
-	Capabilities   []int
+	Stream         shared.AudioStream
+	Capabilities   []shared.ClientCapability
+	PayloadFormat  shared.PayloadFormat
+	Codec          shared.Codec
 	LastSeen       time.Time  `json:"lastSeen"`
 	DisconnectedAt *time.Time `json:"disconnectedAt"`
+	// Sender packetizes the mix going back to the client. It's
+	// only set for clients that can play audio
+	Sender shared.AudioSender
+	// AddrMismatches is how many times audio for this session came
+	// from somewhere other than Addr
+	AddrMismatches uint64 `json:"addrMismatches"`
+	// RebindCounter is the counter from the client's last rebind. Every
+	// rebind has to have a higher one
+	RebindCounter int64
+	// LastRebindRequest is when we last asked the client to rebind
+	LastRebindRequest time.Time
+	// ProtocolVersion is the protocol version the client speaks
+	ProtocolVersion int `json:"protocolVersion"`
+	// AudioFormat is the format of the client's audio. Stream converts
+	// it to the mix format as it plays
+	AudioFormat shared.AudioFormat `json:"audioFormat"`
+	// Network is what we've measured about the client's link
+	Network NetworkStats `json:"network"`
+	// MixConverter converts the mix going back to the client to its
+	// format. It's only set for clients that can play audio
+	MixConverter *shared.FormatConverter
+	// FECGroupSize is how many audio packets the client sends a parity
+	// packet for. It's 0 if the client doesn't send any
+	FECGroupSize int `json:"fecGroupSize"`
+	// FEC rebuilds audio packets the client lost from its parity
+	// packets. It's only set for clients that send them
+	FEC *shared.FECDecoder
+	// Mix is how loud the client is in the mix
+	Mix *MixSettings `json:"-"`
+	// Control authenticates the session's control messages. It's nil
+	// when the session isn't encrypted
+	Control *shared.ControlAuth
+	// Identity is the name the client proved it has by signing with its
+	// own key. It's empty for clients that don't have a key of their own
+	Identity string `json:"identity"`
+}
+
+// SessionOptions are what the server settled on for a client's
+// session while identifying it
+type SessionOptions struct {
+	// PayloadFormat is the payload format the client sends and receives
+	PayloadFormat shared.PayloadFormat
+	// Cipher seals the audio going back to the client. It's nil
+	// when the session isn't encrypted
+	Cipher shared.PacketCipher
+	// ProtocolVersion is the protocol version the client and server settled on
+	ProtocolVersion int
+	// FECGroupSize is how many audio packets the client sends a parity
+	// packet for. It's 0 for no FEC
+	FECGroupSize int
+	// PacketDuration is how much of the mix goes in each packet back to the client
+	PacketDuration time.Duration
+	// Control authenticates the session's control messages. It's nil
+	// when the session isn't encrypted
+	Control *shared.ControlAuth
+	// Identity is the name the client proved it has by signing with its
+	// own key. It's empty for clients that don't have a key of their own
+	Identity string
 }
 
 // ClientStatus is the possible statuses for a client
@@ -27,13 +88,3 @@ const (
 	// ClientStatusDisconnected is the status for when a client is disconnected
 	ClientStatusDisconnected ClientStatus = "disconnected"
 )
-
-// ClientCapability is the capabilities a client has for audio
-type ClientCapability int
-
-const (
-	// ClientCapabilityRecord signals that a client can record audio
-	ClientCapabilityRecord ClientCapability = 1
-	// ClientCapabilityPlayback signals that a client can play audio
-	ClientCapabilityPlayback ClientCapability = 2
-)
@@ -0,0 +1,68 @@
+package clientmanager
+
+import (
+	"fmt"
+	"mediacenter/shared"
+	"sync"
+)
+
+// MixState is how a client sits in the mix
+type MixState struct {
+	// GainDB is how much the client is turned up or down, in decibels
+	GainDB float64 `json:"gainDb"`
+	// Muted clients are left out of the mix
+	Muted bool `json:"muted"`
+	// Solo clients are the only ones in the mix, if there are any
+	Solo bool `json:"solo"`
+}
+
+// Gain is what to multiply the client's audio by. soloing
+// is whether anyone in the mix is soloed
+func (state MixState) Gain(soloing bool) float32 {
+	if state.Muted || (soloing && !state.Solo) {
+		return 0
+	}
+	return shared.DBToGain(state.GainDB)
+}
+
+func (state MixState) String() string {
+	description := fmt.Sprintf("%+.1fdB", state.GainDB)
+	if state.Muted {
+		description += " muted"
+	}
+	if state.Solo {
+		description += " solo"
+	}
+	return description
+}
+
+// MixSettings hold a client's mix state. Every copy of a client shares them,
+// so they can be changed while the client's audio is playing without the
+// change getting lost the next time the client is saved
+type MixSettings struct {
+	mu    sync.Mutex
+	state MixState
+	// Ramp eases the client's audio into changes of gain. It's
+	// only touched by the audio callback
+	Ramp shared.GainRamp
+}
+
+// NewMixSettings creates new mix settings starting out at state
+func NewMixSettings(state MixState) *MixSettings {
+	return &MixSettings{state: state}
+}
+
+// State is the client's mix state
+func (settings *MixSettings) State() MixState {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	return settings.state
+}
+
+// Update changes the client's mix state and returns what it is now
+func (settings *MixSettings) Update(update func(state *MixState)) MixState {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	update(&settings.state)
+	return settings.state
+}
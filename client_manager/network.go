@@ -0,0 +1,81 @@
+package clientmanager
+
+import (
+	"mediacenter/shared"
+	"time"
+)
+
+// NetworkStats are what we've measured about a client's link to us
+type NetworkStats struct {
+	// RTT is the smoothed round trip time of our pings
+	RTT time.Duration `json:"rtt"`
+	// Jitter is the one way jitter of the client's pongs. It's measured
+	// from the client's clock to ours, so the clocks don't have to agree
+	Jitter time.Duration `json:"jitter"`
+	// PacketsReceived is how many audio packets came in from the client
+	PacketsReceived uint64 `json:"packetsReceived"`
+	// PacketsReordered is how many audio packets came in after a later one
+	PacketsReordered uint64 `json:"packetsReordered"`
+	// LossRate is the fraction of the client's audio packets that never came in
+	LossRate float64 `json:"lossRate"`
+	// ReorderRate is the fraction of the client's audio packets that came in out of order
+	ReorderRate float64 `json:"reorderRate"`
+
+	// firstSequence and highestSequence are extended past 32
+	// bits, so they keep counting when sequences wrap around
+	hasSequence     bool
+	firstSequence   int64
+	highestSequence int64
+	hasTransit      bool
+	lastTransit     time.Duration
+}
+
+// RecordPacket counts an audio packet that came in from the client
+func (stats *NetworkStats) RecordPacket(sequence uint32) {
+	if !stats.hasSequence {
+		stats.hasSequence = true
+		stats.firstSequence = int64(sequence)
+		stats.highestSequence = int64(sequence)
+	}
+
+	distance := shared.SequenceDistance(uint32(stats.highestSequence), sequence)
+	if distance > 0 {
+		stats.highestSequence += int64(distance)
+	}
+	if distance < 0 {
+		stats.PacketsReordered++
+	}
+	stats.PacketsReceived++
+
+	// the same way RTP counts loss (RFC 3550 section 6.4.1). Duplicates
+	// can push it below 0, and that's not loss
+	expected := stats.highestSequence - stats.firstSequence + 1
+	lost := max(expected-int64(stats.PacketsReceived), 0)
+	stats.LossRate = float64(lost) / float64(expected)
+	stats.ReorderRate = float64(stats.PacketsReordered) / float64(stats.PacketsReceived)
+}
+
+// RecordPong measures the link from a client's answer to our ping. sent is
+// when we sent the ping, received is when the client got it on its clock
+func (stats *NetworkStats) RecordPong(sent, received, now time.Time) {
+	rtt := now.Sub(sent)
+	if stats.RTT == 0 {
+		stats.RTT = rtt
+	} else {
+		// smoothed the same way TCP smooths its RTT (RFC 6298)
+		stats.RTT += (rtt - stats.RTT) / 8
+	}
+
+	// the transit time includes however far apart our clocks are, but
+	// that cancels out from one pong to the next
+	transit := now.Sub(received)
+	if stats.hasTransit {
+		difference := transit - stats.lastTransit
+		if difference < 0 {
+			difference = -difference
+		}
+		stats.Jitter += (difference - stats.Jitter) / 16
+	}
+	stats.lastTransit = transit
+	stats.hasTransit = true
+}
@@ -9,18 +9,41 @@ import (
 )
 
 // NewClient creates a new client
-func NewClient(name string, addr net.Addr, capabilities []int, sessionToken string) Client {
+func NewClient(
+	identification shared.ClientIdentification,
+	addr net.Addr,
+	sessionToken string,
+	sessionID uint32,
+	codec shared.Codec,
+	sender shared.AudioSender,
+) Client {
 	return Client{
-		Name:         name,
-		SessionToken: sessionToken,
-		Addr:         &addr,
-		Capabilities: capabilities,
-		DataBuffer:   shared.NewThreadSafeBuffer[byte](48000),
-		Status:       ClientStatusConnected,
-		LastSeen:     time.Now(),
+		Name:          identification.Name,
+		SessionToken:  sessionToken,
+		SessionID:     sessionID,
+		Addr:          &addr,
+		Capabilities:  identification.Capabilities,
+		PayloadFormat: codec.Format(),
+		Codec:         codec,
+		Stream:        newClientStream(identification.AudioFormat),
+		Status:        ClientStatusConnected,
+		LastSeen:      time.Now(),
+		Sender:        sender,
+		AudioFormat:   identification.AudioFormat,
+		Mix:           NewMixSettings(MixState{}),
 	}
 }
 
+// newClientStream creates the stream a client's audio plays out of. It's pushed
+// in the client's format and plays in the mix format, at our device's clock
+func newClientStream(format shared.AudioFormat) shared.AudioStream {
+	return shared.NewDriftCompensatedStream(
+		shared.NewAudioStream(format.Channels, format.SampleRate),
+		format,
+		shared.MixFormat,
+	)
+}
+
 // GenerateUUID generates a new UUID
 func GenerateUUID() string {
 	return uuid.NewString()
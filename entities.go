@@ -1,8 +1,62 @@
 package main
 
+import "time"
+
 // Config defines the config for the app
 type Config struct {
+	// ServerHost is the server a client connects straight to, as a host
+	// name or IP with an optional port. Empty means it discovers one
 	ServerHost    string `yaml:"server_host"`
 	ServerPort    int    `yaml:"server_port"`
 	DiscoveryPort int    `yaml:"discovery_port"`
+	// Playback is whether a client plays the server's mix
+	Playback bool `yaml:"playback"`
+	// PlaybackDevice is the name of the device a client plays
+	// the server's mix out of. Empty means the default device
+	PlaybackDevice string `yaml:"playback_device"`
+	// PSK is the pre-shared key. When it's set, all audio between
+	// the server and its clients is encrypted
+	PSK string `yaml:"psk"`
+	// AuthSecret is the secret clients authenticate with. Servers accept
+	// it from any client without its own key in ClientKeys
+	AuthSecret string `yaml:"auth_secret"`
+	// AuthKey is a client's own key, if it has one. Clients without one
+	// authenticate with AuthSecret
+	AuthKey string `yaml:"auth_key"`
+	// ClientKeys is a map of client name to that client's own key
+	ClientKeys map[string]string `yaml:"client_keys"`
+	// ServerName is the name a server goes by, empty meaning the host
+	// name. Clients pick the server by this name when more than one answers
+	ServerName string `yaml:"server_name"`
+	// MDNS is whether servers advertise themselves, and clients
+	// browse for them, over mDNS
+	MDNS bool `yaml:"mdns"`
+	// DiscoveryFallback is whether a client with a ServerHost falls
+	// back to discovery when it can't connect to it
+	DiscoveryFallback bool `yaml:"discovery_fallback"`
+	// Transport is how a client gets packets to the server: udp, tcp, or
+	// websocket. Empty means udp. tcp and websocket need a ServerHost
+	Transport string `yaml:"transport"`
+	// TCPPort is the port servers take TCP clients on. 0 means they don't
+	TCPPort int `yaml:"tcp_port"`
+	// WebSocketPort is the port servers take WebSocket clients on. 0 means they don't
+	WebSocketPort int `yaml:"websocket_port"`
+	// SampleRate is the sample rate a client's devices run at, like
+	// 44100 for some USB interfaces. 0 means the server's rate
+	SampleRate int `yaml:"sample_rate"`
+	// Channels is the channel count a client's devices run with, like
+	// 1 for a mono mic. 0 means the server's channel count
+	Channels int `yaml:"channels"`
+	// FECGroupSize is how many audio packets a client sends a parity packet
+	// for, like 4 on lossy Wi-Fi. 0 turns FEC off
+	FECGroupSize int `yaml:"fec_group_size"`
+	// PacketDuration is how much audio goes in each packet, like 2.5ms or
+	// 20ms. Empty means 5ms. Longer packets are fewer but add latency. It's
+	// capped at 20ms, and at however much fits in a 1400 byte packet, which
+	// is about 3.6ms for float32 stereo at 48kHz and 7.3ms for pcm16
+	PacketDuration time.Duration `yaml:"packet_duration"`
+	// AdminAddr is where a server's admin API listens for changes to the
+	// mix, like 127.0.0.1:8890. Requests need AuthSecret as a bearer token,
+	// and without one it has to be a loopback address. Empty means it's off
+	AdminAddr string `yaml:"admin_addr"`
 }
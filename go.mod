@@ -2,10 +2,13 @@ module mediacenter
 
 go 1.25.3
 
-require gopkg.in/yaml.v3 v3.0.1
-
 require (
-	github.com/gen2brain/malgo v0.11.24 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	go.uber.org/multierr v1.11.0 // indirect
+	github.com/gen2brain/malgo v0.11.24
+	github.com/google/uuid v1.6.0
+	go.uber.org/multierr v1.11.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.57.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.47.0 // indirect
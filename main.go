@@ -1,11 +1,13 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"mediacenter/client"
 	clientmanager "mediacenter/client_manager"
 	"mediacenter/server"
+	"mediacenter/shared"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -25,21 +27,64 @@ func main() {
 
 	role := os.Getenv("MC_ROLE")
 
+	clientOptions := client.Options{
+		DiscoveryPort:  config.DiscoveryPort,
+		Name:           os.Getenv("MC_NAME"),
+		Playback:       config.Playback,
+		PlaybackDevice: config.PlaybackDevice,
+		PSK:            config.PSK,
+		AuthKey:        cmp.Or(config.AuthKey, config.AuthSecret),
+		MDNS:           config.MDNS,
+
+		ServerHost:        config.ServerHost,
+		DiscoveryFallback: config.DiscoveryFallback,
+		ServerName:        config.ServerName,
+		Transport:         shared.Transport(config.Transport),
+		TCPPort:           config.TCPPort,
+		WebSocketPort:     config.WebSocketPort,
+		SampleRate:        config.SampleRate,
+		Channels:          config.Channels,
+		FECGroupSize:      config.FECGroupSize,
+		PacketDuration:    config.PacketDuration,
+	}
+
 	var shutdown func() error
 	switch role {
 	case "test":
 		RunPlayground()
 		os.Exit(0)
+	case "list":
+		servers, err := client.NewMediaClient(clientOptions).ListServers()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Found %d servers:\n", len(servers))
+		for _, server := range servers {
+			fmt.Printf("\t%s\n", server)
+		}
+		os.Exit(0)
 	case "server":
 		rootCtx := context.Background()
 		serverCtx, cancel := context.WithCancel(rootCtx)
 		defer cancel()
 		clientManager := clientmanager.NewClientManager(serverCtx)
-		mediaServer := server.NewMediaServer(config.ServerPort, config.DiscoveryPort, clientManager)
+		mediaServer := server.NewMediaServer(server.Options{
+			ServerPort:     config.ServerPort,
+			DiscoveryPort:  config.DiscoveryPort,
+			PSK:            config.PSK,
+			AuthSecret:     config.AuthSecret,
+			ClientKeys:     config.ClientKeys,
+			Name:           config.ServerName,
+			MDNS:           config.MDNS,
+			TCPPort:        config.TCPPort,
+			WebSocketPort:  config.WebSocketPort,
+			PacketDuration: config.PacketDuration,
+			AdminAddr:      config.AdminAddr,
+		}, clientManager)
 		shutdown, err = mediaServer.Start()
 	default:
 		role = "client"
-		mediaClient := client.NewMediaClient(config.DiscoveryPort, os.Getenv("MC_NAME"))
+		mediaClient := client.NewMediaClient(clientOptions)
 		shutdown, err = mediaClient.Start()
 	}
 	if err != nil {
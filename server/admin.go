@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	clientmanager "mediacenter/client_manager"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The admin API changes the mix while the server's running. It's JSON over HTTP:
+//
+//	GET /clients lists the connected clients and where they sit in the mix
+//	PATCH /clients/{sessionID}/mix changes any of a client's gainDb, muted and solo
+//
+// If the server has an auth secret, every request needs it as a bearer token.
+// If it doesn't, the admin API only listens on loopback
+
+// adminClient is a client as the admin API shows it
+type adminClient struct {
+	SessionID uint32 `json:"sessionId"`
+	Name      string `json:"name"`
+	clientmanager.MixState
+}
+
+// mixUpdate is a change to a client's mix state. Anything left out stays the same
+type mixUpdate struct {
+	GainDB *float64 `json:"gainDb"`
+	Muted  *bool    `json:"muted"`
+	Solo   *bool    `json:"solo"`
+}
+
+// startAdmin starts the admin API, if we have an address for it. Without an
+// auth secret, anyone who can reach it can change the mix, so it won't
+// start anywhere but loopback
+func (s *MediaServer) startAdmin(ctx context.Context) error {
+	if s.adminAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.adminAddr)
+	if err != nil {
+		return err
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); s.adminSecret == "" && (!ok || !addr.IP.IsLoopback()) {
+		listener.Close()
+		return fmt.Errorf("admin API on %s isn't on loopback, so it needs an auth secret", listener.Addr())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", s.authorize(s.handleListClients))
+	mux.HandleFunc("PATCH /clients/{sessionID}/mix", s.authorize(s.handleUpdateMix))
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: AdminReadTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("admin API stopped: %s\n", err.Error())
+		}
+	}()
+
+	fmt.Printf("Admin API listening on %s\n", listener.Addr())
+	return nil
+}
+
+// authorize only lets requests through to handler if they have our auth
+// secret as their bearer token, when we have one
+func (s *MediaServer) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminSecret != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminSecret)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (s *MediaServer) handleListClients(w http.ResponseWriter, _ *http.Request) {
+	clients := s.clients.ConnectedClients()
+	response := make([]adminClient, 0, len(clients))
+	for _, client := range clients {
+		response = append(response, adminClient{
+			SessionID: client.SessionID,
+			Name:      client.Name,
+			MixState:  client.Mix.State(),
+		})
+	}
+
+	writeJSON(w, response)
+}
+
+func (s *MediaServer) handleUpdateMix(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.ParseUint(r.PathValue("sessionID"), 10, 32)
+	if err != nil {
+		http.Error(w, "bad session ID", http.StatusBadRequest)
+		return
+	}
+	client, found := s.clients.GetClientBySessionID(uint32(sessionID))
+	if !found || client.Status != clientmanager.ClientStatusConnected {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+
+	var update mixUpdate
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxAdminRequestLen)).Decode(&update)
+	if err != nil {
+		http.Error(w, "bad mix update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.GainDB != nil && (*update.GainDB < MinGainDB || *update.GainDB > MaxGainDB) {
+		http.Error(w, fmt.Sprintf("gain has to be between %ddB and %ddB", MinGainDB, MaxGainDB), http.StatusBadRequest)
+		return
+	}
+
+	state := client.Mix.Update(func(state *clientmanager.MixState) {
+		if update.GainDB != nil {
+			state.GainDB = *update.GainDB
+		}
+		if update.Muted != nil {
+			state.Muted = *update.Muted
+		}
+		if update.Solo != nil {
+			state.Solo = *update.Solo
+		}
+	})
+	fmt.Printf("%s is now at %.1fdB, muted: %t, solo: %t\n", client.Name, state.GainDB, state.Muted, state.Solo)
+
+	writeJSON(w, adminClient{
+		SessionID: client.SessionID,
+		Name:      client.Name,
+		MixState:  state,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		fmt.Printf("error writing admin response: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"mediacenter/shared"
+	"net"
+	"time"
+)
+
+// Auth challenges are stateless, so anyone asking for them can't fill up anything
+// on our end and crowd real clients out. A challenge (big endian) is:
+//
+//	issued at, in unix nanoseconds (8) | random nonce (8) | MAC (16)
+//
+// where the MAC covers everything before it and the address it was sent to, under
+// a secret only we know. A client can answer the same challenge more than once
+// until it expires, but every answer has to be signed with its key, and covers
+// its key exchange public key, so replaying one doesn't get anyone a session key
+
+// newChallengeSecret creates a new secret to MAC auth challenges with. It's new
+// every time we start, so challenges from before a restart don't work
+func newChallengeSecret() []byte {
+	secret := make([]byte, ChallengeSecretLen)
+	// reading randomness never fails on the systems Go runs on
+	rand.Read(secret)
+	return secret
+}
+
+// authRequired tells you if clients need to authenticate to identify
+func (server *ListenerServer) authRequired() bool {
+	return server.authSecret != "" || len(server.clientKeys) > 0
+}
+
+// clientKey finds the key a client signs challenges with. Per-client keys win
+// over the shared secret
+func (server *ListenerServer) clientKey(name string) (string, bool) {
+	if key, ok := server.clientKeys[name]; ok {
+		return key, true
+	}
+	if server.authSecret != "" {
+		return server.authSecret, true
+	}
+
+	return "", false
+}
+
+// identity is the name a client proved it has, if it has its own key. Anyone
+// who knows the shared secret can sign as any name, so that proves nothing
+func (server *ListenerServer) identity(name string) string {
+	if _, ok := server.clientKeys[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// sendChallenge sends the client a new challenge to sign
+func (server *ListenerServer) sendChallenge(conn net.PacketConn, dst net.Addr) error {
+	challenge := make([]byte, shared.AuthChallengeLen-sha256.Size/2)
+	binary.BigEndian.PutUint64(challenge, uint64(time.Now().UnixNano()))
+	_, err := rand.Read(challenge[8:])
+	if err != nil {
+		return err
+	}
+	challenge = append(challenge, server.challengeMAC(challenge, dst)...)
+
+	_, err = conn.WriteTo(shared.CraftAuthChallenge(challenge), dst)
+	return err
+}
+
+// challengeMAC MACs a challenge along with where we sent it
+func (server *ListenerServer) challengeMAC(challenge []byte, dst net.Addr) []byte {
+	mac := hmac.New(sha256.New, server.challengeSecret)
+	mac.Write(challenge)
+	mac.Write([]byte(dst.String()))
+	return mac.Sum(nil)[:sha256.Size/2]
+}
+
+// checkChallenge tells you if we sent this challenge to src, and it hasn't expired yet
+func (server *ListenerServer) checkChallenge(challenge []byte, src net.Addr) bool {
+	if len(challenge) != shared.AuthChallengeLen {
+		return false
+	}
+
+	body := challenge[:shared.AuthChallengeLen-sha256.Size/2]
+	if !hmac.Equal(challenge[len(body):], server.challengeMAC(body, src)) {
+		return false
+	}
+
+	age := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(body))))
+	return age >= 0 && age <= AuthChallengeTimeout
+}
+
+// authenticate checks the client's answer to our challenge. It returns
+// why the client was rejected, or nothing if they're good
+func (server *ListenerServer) authenticate(identification shared.ClientIdentification, src net.Addr) shared.RejectionReason {
+	if !server.checkChallenge(identification.AuthChallenge, src) {
+		return shared.RejectionReasonChallengeExpired
+	}
+
+	key, ok := server.clientKey(identification.Name)
+	if !ok {
+		return shared.RejectionReasonUnknownClient
+	}
+
+	if !shared.VerifyAuthChallenge(key, identification.AuthChallenge, identification) {
+		return shared.RejectionReasonAuthFailed
+	}
+
+	return ""
+}
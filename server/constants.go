@@ -1,11 +1,44 @@
 package server
 
-import "mediacenter/shared"
+import "time"
 
 const (
-	// AudioBufferSize is the size of the audio buffer
-	AudioBufferSize = 48000
-	// AudioBufferThreshold is the threshold of content
-	// the audio buffer must reach to start playing audio
-	AudioBufferThreshold = shared.NumOutputChannels * shared.AudioSampleRate / 4
+	// ChallengeSecretLen is the length of the secret auth challenges are MACed with
+	ChallengeSecretLen = 32
+	// AuthChallengeTimeout is how long a client has to answer
+	// an auth challenge
+	AuthChallengeTimeout = time.Second * 10
+	// RebindRequestInterval is the least amount of time between asking
+	// a client to rebind its session
+	RebindRequestInterval = time.Second
+	// ReidentifyRequestInterval is the least amount of time between telling
+	// a session to identify again
+	ReidentifyRequestInterval = time.Second
+	// MaxPendingReidentifyRequests is the most sessions we remember telling
+	// to identify again
+	MaxPendingReidentifyRequests = 256
+	// PingInterval is how often we ping every client to
+	// measure its link
+	PingInterval = time.Second
+	// PresentationDelay is how long after we mix audio playback clients
+	// play it. It has to cover getting the mix to every client
+	PresentationDelay = time.Millisecond * 80
+	// MixClockSmoothing is how many audio callbacks the time we stamp
+	// the mix with is smoothed over, since callbacks come in a bit
+	// early or late
+	MixClockSmoothing = 64
+	// MixClockResyncThreshold is how far off the mix's time can get
+	// from when callbacks actually come in before we start it over
+	MixClockResyncThreshold = time.Millisecond * 20
+	// MixQueueLen is how many mixes can wait to be sent back out to
+	// playback clients before we start dropping them (40ms)
+	MixQueueLen = 8
+	// MinGainDB and MaxGainDB are how far a client can be
+	// turned down and up in the mix
+	MinGainDB = -60
+	MaxGainDB = 12
+	// AdminReadTimeout is how long the admin API waits on a request
+	AdminReadTimeout = time.Second * 10
+	// MaxAdminRequestLen is the biggest request body the admin API reads
+	MaxAdminRequestLen = 4096
 )
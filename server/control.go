@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	clientmanager "mediacenter/client_manager"
+	"mediacenter/shared"
+	"net"
+	"time"
+)
+
+// handleControlMessage handles the control messages clients send
+// alongside their audio
+func (s *MediaServer) handleControlMessage(message string, src net.Addr) error {
+	control, err := shared.ReadControlMessage(message)
+	if err == shared.ErrNotControlMessage {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client, found := s.clients.GetClientBySessionID(control.SessionID)
+	if !found {
+		if control.Keyword == shared.HeartbeatKeyword {
+			s.requestReidentify(control.SessionID, src, shared.RejectionReasonUnknownSession)
+		}
+		return fmt.Errorf("could not find client with session ID %d", control.SessionID)
+	}
+
+	// under a pre-shared key, anything that isn't signed with the session's
+	// key could have come from anyone who can spoof the client's address
+	if !client.Control.Verify(message) {
+		return fmt.Errorf(
+			"SECURITY: rejected unauthenticated %s for %s (session %d) from %s",
+			control.Keyword,
+			client.Name,
+			client.SessionID,
+			src.String(),
+		)
+	}
+
+	switch control.Keyword {
+	case shared.SessionRebindKeyword:
+		return s.handleRebind(client, control, src)
+	case shared.HeartbeatKeyword:
+		return s.handleHeartbeat(client, control, src)
+	case shared.GoodbyeKeyword:
+		return s.handleGoodbye(client, src)
+	case shared.PongKeyword:
+		return s.handlePong(client, control, src)
+	default:
+		return nil
+	}
+}
+
+// handleHeartbeat keeps a client's session alive while it isn't sending audio,
+// and lets the client know we're still around. If the client says when it sent
+// the heartbeat, we say when we got it and answered, so it can sync its clock to ours
+func (s *MediaServer) handleHeartbeat(client clientmanager.Client, control shared.ControlMessage, src net.Addr) error {
+	received := time.Now()
+	if !sameAddr(client.Addr, src) {
+		s.handleAddrMismatch(client, src)
+		return nil
+	}
+	if client.Status != clientmanager.ClientStatusConnected {
+		s.requestReidentify(client.SessionID, src, shared.RejectionReasonSessionExpired)
+		return nil
+	}
+
+	client.LastSeen = received
+	s.clients.SetClient(client)
+
+	var items []string
+	if sent, ok := control.Items[shared.ControlSentKey]; ok {
+		items = append(
+			items,
+			shared.ControlSentKey, sent,
+			shared.ControlReceivedKey, shared.EncodeControlTime(received),
+			shared.ControlTransmitKey, shared.EncodeControlTime(time.Now()),
+		)
+	}
+	return s.writeTo(client.Control.Craft(shared.HeartbeatAckKeyword, client.SessionID, items...), src)
+}
+
+// sendPings pings every client once every PingInterval until we shut down, so
+// we always know what their links look like
+func (s *MediaServer) sendPings(ctx context.Context) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, client := range s.clients.ConnectedClients() {
+			if client.Addr == nil {
+				continue
+			}
+			s.writeTo(client.Control.Craft(
+				shared.PingKeyword,
+				client.SessionID,
+				shared.ControlSentKey, shared.EncodeControlTime(time.Now()),
+			), *client.Addr)
+		}
+	}
+}
+
+// handlePong measures a client's link from its answer to our ping
+func (s *MediaServer) handlePong(client clientmanager.Client, control shared.ControlMessage, src net.Addr) error {
+	now := time.Now()
+	if !sameAddr(client.Addr, src) {
+		s.handleAddrMismatch(client, src)
+		return nil
+	}
+
+	sent, err := control.Time(shared.ControlSentKey)
+	if err != nil {
+		return err
+	}
+	received, err := control.Time(shared.ControlReceivedKey)
+	if err != nil {
+		return err
+	}
+	// the client only ever echoes our own timestamps, so one
+	// from the future isn't from us
+	if sent.After(now) {
+		return fmt.Errorf("pong from %s (session %d) is from the future", client.Name, client.SessionID)
+	}
+
+	client.Network.RecordPong(sent, received, now)
+	client.LastSeen = now
+	s.clients.SetClient(client)
+	return nil
+}
+
+// handleAddrMismatch deals with audio for a session coming from an address we
+// don't know. That's either someone trying to inject audio into the session, or
+// the client's address changed. We drop the audio either way, and ask whoever
+// sent it to prove they own the session
+func (s *MediaServer) handleAddrMismatch(client clientmanager.Client, src net.Addr) {
+	client.AddrMismatches++
+	fmt.Printf(
+		"SECURITY: audio for %s (session %d) came from %s, expected %s (%d mismatches)\n",
+		client.Name,
+		client.SessionID,
+		src.String(),
+		(*client.Addr).String(),
+		client.AddrMismatches,
+	)
+
+	// Don't let a flood of spoofed audio turn us into a flood of requests
+	if time.Since(client.LastRebindRequest) >= RebindRequestInterval {
+		client.LastRebindRequest = time.Now()
+		s.writeTo(client.Control.Craft(
+			shared.SessionRebindRequiredKeyword,
+			client.SessionID,
+			shared.ControlAddrKey, src.String(),
+		), src)
+	}
+
+	s.clients.SetClient(client)
+}
+
+// handleGoodbye lets a client go as soon as it tells us it's leaving, instead
+// of waiting for it to time out. Whatever it had left to play fades out
+func (s *MediaServer) handleGoodbye(client clientmanager.Client, src net.Addr) error {
+	if !sameAddr(client.Addr, src) {
+		return fmt.Errorf(
+			"SECURITY: goodbye for %s (session %d) came from %s, expected %s",
+			client.Name,
+			client.SessionID,
+			src.String(),
+			(*client.Addr).String(),
+		)
+	}
+
+	client, ok := s.clients.DisconnectClient(client.SessionID)
+	if !ok {
+		return nil
+	}
+	s.sessionCiphers.Remove(client.SessionID)
+	client.Stream.FadeOut()
+	s.leaving.Set(client.SessionID, client)
+
+	fmt.Printf("%s (session %d) said goodbye\n", client.Name, client.SessionID)
+	s.clients.PrintStatuses()
+	return nil
+}
+
+// requestReidentify tells whoever sent audio for a session we can't take audio for
+// that they need to identify again. It's rate limited per session, since the
+// client keeps streaming until it hears back. If we still know the session we
+// sign the request with its key. If we don't, we can't, and a client with a
+// pre-shared key won't listen. It'll notice we've gone quiet and reconnect anyway
+func (s *MediaServer) requestReidentify(sessionID uint32, src net.Addr, reason shared.RejectionReason) {
+	var control *shared.ControlAuth
+	if client, found := s.clients.GetClientBySessionID(sessionID); found {
+		control = client.Control
+	}
+
+	s.reidentifyMu.Lock()
+	defer s.reidentifyMu.Unlock()
+	if time.Since(s.reidentifyRequests[sessionID]) < ReidentifyRequestInterval {
+		return
+	}
+	if len(s.reidentifyRequests) >= MaxPendingReidentifyRequests {
+		clear(s.reidentifyRequests)
+	}
+	s.reidentifyRequests[sessionID] = time.Now()
+
+	fmt.Printf("asking %s to identify again: %s\n", src.String(), reason)
+	s.writeTo(control.Craft(
+		shared.SessionReidentifyKeyword,
+		sessionID,
+		shared.ControlReasonKey, string(reason),
+	), src)
+}
+
+// handleRebind moves a session to the address the rebind came from, as long as
+// the client can prove it owns the session
+func (s *MediaServer) handleRebind(client clientmanager.Client, control shared.ControlMessage, src net.Addr) error {
+	counter, err := control.Int(shared.ControlCounterKey)
+	if err != nil {
+		return err
+	}
+	proof, err := control.Bytes(shared.ControlProofKey)
+	if err != nil {
+		return err
+	}
+
+	addr := control.Items[shared.ControlAddrKey]
+	if addr != src.String() ||
+		counter <= client.RebindCounter ||
+		!shared.VerifyRebind(client.Control.RebindKey(client.SessionToken), client.SessionID, addr, counter, proof) {
+		client.AddrMismatches++
+		s.clients.SetClient(client)
+		return fmt.Errorf(
+			"SECURITY: rejected rebind of %s (session %d) to %s, counter %d",
+			client.Name,
+			client.SessionID,
+			src.String(),
+			counter,
+		)
+	}
+
+	fmt.Printf("%s (session %d) moved from %s to %s\n", client.Name, client.SessionID, (*client.Addr).String(), src.String())
+	var newAddr net.Addr = src
+	client.Addr = &newAddr
+	client.RebindCounter = counter
+	client.LastSeen = time.Now()
+	s.clients.SetClient(client)
+	return nil
+}
+
+// sameAddr tells you if a client's recorded address is addr
+func sameAddr(clientAddr *net.Addr, addr net.Addr) bool {
+	return clientAddr != nil && *clientAddr != nil && (*clientAddr).String() == addr.String()
+}
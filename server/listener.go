@@ -7,22 +7,51 @@ import (
 	"mediacenter/shared"
 	"net"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // ListenerServer listens for new connections
 type ListenerServer struct {
 	port            int
 	mainServicePort int
+	psk             string
+	authSecret      string
+	clientKeys      map[string]string
+	// packetDuration is how much of the mix goes in each packet back to clients
+	packetDuration time.Duration
+	// name and id are what we tell clients looking for servers. The
+	// id tells us apart from other servers with the same name
+	name string
+	id   string
+	// challengeSecret is what our auth challenges are MACed with
+	challengeSecret []byte
 
 	clients clientmanager.ClientManager
+	// sessionCiphers is a map of session ID to the cipher for audio
+	// coming in from that session
+	sessionCiphers shared.ThreadSafeMap[uint32, shared.PacketCipher]
 }
 
 // NewListenerServer starts a new listener server
-func NewListenerServer(port int, mainServicePort int, clientManager clientmanager.ClientManager) *ListenerServer {
+func NewListenerServer(
+	options Options,
+	clientManager clientmanager.ClientManager,
+	sessionCiphers shared.ThreadSafeMap[uint32, shared.PacketCipher],
+) *ListenerServer {
 	return &ListenerServer{
-		port:            port,
-		mainServicePort: mainServicePort,
+		port:            options.DiscoveryPort,
+		mainServicePort: options.ServerPort,
+		name:            serverName(options),
+		id:              uuid.NewString(),
+		psk:             options.PSK,
+		authSecret:      options.AuthSecret,
+		clientKeys:      options.ClientKeys,
+		packetDuration:  options.PacketDuration,
+		challengeSecret: newChallengeSecret(),
 		clients:         clientManager,
+		sessionCiphers:  sessionCiphers,
 	}
 }
 
@@ -32,13 +61,21 @@ func (server *ListenerServer) Start(ctx context.Context) error {
 	go func() {
 		defer close(errChan)
 
-		listener, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", server.port))
+		// "udp" listens on both IPv4 and IPv6 wherever the system can
+		listener, err := net.ListenPacket("udp", fmt.Sprintf(":%d", server.port))
 		if err != nil {
 			errChan <- err
 			return
 		}
 		defer listener.Close()
 
+		// IPv6 has no broadcast, so IPv6 clients look for us on a
+		// multicast group instead. IPv4 discovery still works without it
+		err = shared.JoinIPv6Group(listener, net.ParseIP(shared.DiscoveryMulticastGroup))
+		if err != nil {
+			fmt.Printf("IPv6 discovery is unavailable: %s\n", err.Error())
+		}
+
 		// we've done all the scary work with starting the
 		// listener server, so we can stop worrying
 		// about errors (for now, we should log errors at some point)
@@ -58,20 +95,7 @@ func (server *ListenerServer) Start(ctx context.Context) error {
 			bufferContent := strings.TrimRight(string(buffer), "\x00")
 			shared.ZeroSlice(buffer)
 
-			fmt.Printf("Received message from %s: %s\n", clientAddr.String(), bufferContent)
-
-			actionRequest := shared.IdentifyServerAction(bufferContent)
-			switch actionRequest {
-			case shared.ServerActionDiscover:
-				err = server.handleDiscoveryRequest(bufferContent, listener, clientAddr)
-			case shared.ServerActionIdentification:
-				err = server.handleClientIdentificationRequest(bufferContent, listener, clientAddr)
-			default:
-				continue
-			}
-			if err != nil {
-				fmt.Printf("Error communicating with client: %s\n", err.Error())
-			}
+			server.handleMessage(bufferContent, listener, clientAddr)
 		}
 	}()
 
@@ -85,37 +109,187 @@ func (server *ListenerServer) Start(ctx context.Context) error {
 	return nil
 }
 
+// handleMessage handles a discovery or identification message. Responses go back
+// out through conn, which is the listener's own connection for UDP, and the
+// client's stream for TCP and WebSockets
+func (server *ListenerServer) handleMessage(message string, conn net.PacketConn, clientAddr net.Addr) {
+	fmt.Printf("Received message from %s: %s\n", clientAddr.String(), message)
+
+	var err error
+	switch shared.IdentifyServerAction(message) {
+	case shared.ServerActionDiscover:
+		err = server.handleDiscoveryRequest(message, conn, clientAddr)
+	case shared.ServerActionIdentification:
+		err = server.handleClientIdentificationRequest(message, conn, clientAddr)
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error communicating with client: %s\n", err.Error())
+	}
+}
+
 // handleDiscoverRequest takes in discovery requests and returns the port of the main server to the client.
 // Since we don't know if this client will ever be anything, we don't need to store anything from this interaction
 // until the client introduces themselves
 func (server *ListenerServer) handleDiscoveryRequest(message string, conn net.PacketConn, dst net.Addr) error {
-	if message != shared.ServerDiscoveryKeyword {
-		return nil
+	isDiscovery, versions, err := shared.ReadServerDiscoveryRequest(message)
+	if !isDiscovery || err != nil {
+		return err
 	}
 
-	_, err := conn.WriteTo(shared.CraftServerDiscoveryResponse(server.mainServicePort), dst)
+	// clients from before version negotiation just send the keyword,
+	// and don't understand anything but the port in the response
+	if message == shared.ServerDiscoveryKeyword {
+		_, err = conn.WriteTo(shared.CraftServerDiscoveryResponse(shared.DiscoveryResponse{
+			Port: server.mainServicePort,
+		}), dst)
+		return err
+	}
+
+	response := shared.DiscoveryResponse{
+		Port:             server.mainServicePort,
+		ProtocolVersions: shared.SupportedProtocolVersions,
+		Name:             server.name,
+		ID:               server.id,
+	}
+	version, ok := shared.PickProtocolVersion(shared.SupportedProtocolVersions, versions)
+	if ok {
+		response.ProtocolVersion = version
+	} else {
+		response.Reason = shared.RejectionReasonUnsupportedVersion
+		fmt.Printf(
+			"refusing %s: it speaks protocol versions %s, we speak %s\n",
+			dst.String(),
+			versions,
+			shared.SupportedProtocolVersions,
+		)
+	}
+
+	_, err = conn.WriteTo(shared.CraftServerDiscoveryResponse(response), dst)
 	return err
 }
 
 // handleClientIdentificationRequest handles incoming client identification requests
 func (server *ListenerServer) handleClientIdentificationRequest(message string, conn net.PacketConn, dst net.Addr) error {
-	isIdentificationMessage, name, capabilities, err := shared.ReadClientIdentificationMessage(message)
+	isIdentificationMessage, identification, err := shared.ReadClientIdentificationMessage(message)
 	if err != nil {
-		conn.WriteTo(shared.CraftClientIdentificationResponse(false, ""), dst)
+		server.reject(conn, dst, shared.RejectionReasonBadRequest)
 		return err
 	}
 	if !isIdentificationMessage {
 		return nil
 	}
 
-	client, err := server.clients.AddClient(name, dst, capabilities)
+	if server.authRequired() {
+		if len(identification.AuthSignature) == 0 {
+			return server.sendChallenge(conn, dst)
+		}
+
+		reason := server.authenticate(identification, dst)
+		if reason != "" {
+			server.reject(conn, dst, reason)
+			return fmt.Errorf("rejected %s from %s: %s", identification.Name, dst.String(), reason)
+		}
+	}
+
+	protocolVersion, ok := shared.PickProtocolVersion(shared.SupportedProtocolVersions, identification.ProtocolVersions)
+	if !ok {
+		server.reject(conn, dst, shared.RejectionReasonUnsupportedVersion)
+		return fmt.Errorf(
+			"%s speaks protocol versions %s, we speak %s",
+			identification.Name,
+			identification.ProtocolVersions,
+			shared.SupportedProtocolVersions,
+		)
+	}
+
+	if !identification.AudioFormat.Valid() {
+		server.reject(conn, dst, shared.RejectionReasonUnsupportedAudioFormat)
+		return fmt.Errorf("can't take audio from %s in %s", identification.Name, identification.AudioFormat)
+	}
+
+	payloadFormat, ok := shared.PickPayloadFormat(shared.SupportedPayloadFormats, identification.PayloadFormats)
+	if !ok {
+		server.reject(conn, dst, shared.RejectionReasonNoCommonFormat)
+		return fmt.Errorf("no payload format in common with %s", identification.Name)
+	}
+
+	ciphers, publicKey, err := server.exchangeKeys(identification)
 	if err != nil {
-		conn.WriteTo(shared.CraftClientIdentificationResponse(false, ""), dst)
+		server.reject(conn, dst, shared.RejectionReasonKeyExchange)
 		return err
 	}
 
+	client, err := server.clients.AddClient(identification, dst, clientmanager.SessionOptions{
+		PayloadFormat:   payloadFormat,
+		Cipher:          ciphers.ToClient,
+		ProtocolVersion: protocolVersion,
+		FECGroupSize:    min(identification.FECGroupSize, shared.MaxFECGroupSize),
+		PacketDuration:  server.packetDuration,
+		Control:         ciphers.ControlAuth(shared.AudioDirectionToClient),
+		Identity:        server.identity(identification.Name),
+	})
+	if err != nil {
+		server.reject(conn, dst, shared.RejectionReasonServerFull)
+		return err
+	}
+	if ciphers.ToServer != nil {
+		server.sessionCiphers.Set(client.SessionID, ciphers.ToServer)
+	}
+
 	server.clients.PrintStatuses()
 
-	_, err = conn.WriteTo(shared.CraftClientIdentificationResponse(true, client.SessionToken), dst)
+	// under a pre-shared key, the session token never leaves us. The client
+	// proves everything with the session key instead, and a token sent in
+	// the clear would only be something for someone listening to steal
+	sessionToken := client.SessionToken
+	if server.psk != "" {
+		sessionToken = ""
+	}
+
+	_, err = conn.WriteTo(shared.CraftClientIdentificationResponse(shared.IdentificationResult{
+		OK:               true,
+		SessionToken:     sessionToken,
+		SessionID:        client.SessionID,
+		PayloadFormat:    client.PayloadFormat,
+		PublicKey:        publicKey,
+		KeyConfirmation:  ciphers.Confirmation,
+		ProtocolVersion:  client.ProtocolVersion,
+		ProtocolVersions: shared.SupportedProtocolVersions,
+		FECGroupSize:     client.FECGroupSize,
+	}), dst)
 	return err
 }
+
+// reject tells the client we won't identify them and why
+func (server *ListenerServer) reject(conn net.PacketConn, dst net.Addr, reason shared.RejectionReason) {
+	conn.WriteTo(shared.CraftClientIdentificationResponse(shared.IdentificationResult{
+		OK:               false,
+		Reason:           reason,
+		ProtocolVersions: shared.SupportedProtocolVersions,
+	}), dst)
+}
+
+// exchangeKeys does our side of the session key exchange. If we don't have a
+// pre-shared key, the session isn't encrypted and there's nothing to exchange
+func (server *ListenerServer) exchangeKeys(identification shared.ClientIdentification) (shared.SessionCiphers, []byte, error) {
+	if server.psk == "" {
+		return shared.SessionCiphers{}, nil, nil
+	}
+	if len(identification.PublicKey) == 0 {
+		return shared.SessionCiphers{}, nil, fmt.Errorf("%s didn't offer a key exchange", identification.Name)
+	}
+
+	private, err := shared.GenerateKeyExchangeKey()
+	if err != nil {
+		return shared.SessionCiphers{}, nil, err
+	}
+
+	ciphers, err := shared.DeriveSessionCiphers(private, identification.PublicKey, server.psk)
+	if err != nil {
+		return shared.SessionCiphers{}, nil, err
+	}
+
+	return ciphers, private.PublicKey().Bytes(), nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mediacenter/shared"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// MDNSServer advertises the server as a DNS-SD service over mDNS, so it can be
+// found across networks with mDNS reflectors, and by standard tools
+type MDNSServer struct {
+	service shared.MDNSService
+}
+
+// NewMDNSServer creates a new mDNS server
+func NewMDNSServer(options Options) *MDNSServer {
+	return &MDNSServer{
+		service: shared.NewMDNSService(serverName(options), options.DiscoveryPort, options.ServerPort),
+	}
+}
+
+// Start starts answering mDNS queries on IPv4 and, if we can, IPv6
+func (server *MDNSServer) Start(ctx context.Context) error {
+	var conns []*net.UDPConn
+	conn4, err4 := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{
+		IP:   net.ParseIP(shared.MDNSGroupIPv4),
+		Port: shared.MDNSPort,
+	})
+	if err4 == nil {
+		// the default interface is already in the group, but any others aren't
+		packetConn := ipv4.NewPacketConn(conn4)
+		for _, ifi := range shared.MulticastInterfaces() {
+			packetConn.JoinGroup(&ifi, &net.UDPAddr{IP: net.ParseIP(shared.MDNSGroupIPv4)})
+		}
+		conns = append(conns, conn4)
+	}
+	conn6, err6 := net.ListenMulticastUDP("udp6", nil, &net.UDPAddr{
+		IP:   net.ParseIP(shared.MDNSGroupIPv6),
+		Port: shared.MDNSPort,
+	})
+	if err6 == nil {
+		shared.JoinIPv6Group(conn6, net.ParseIP(shared.MDNSGroupIPv6))
+		conns = append(conns, conn6)
+	}
+	if len(conns) == 0 {
+		return errors.Join(err4, err6)
+	}
+
+	for _, conn := range conns {
+		go server.serve(conn)
+		server.announce(conn)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	fmt.Printf("Advertising %s over mDNS\n", server.service.Instance())
+	return nil
+}
+
+// serve answers queries until the connection gets closed
+func (server *MDNSServer) serve(conn *net.UDPConn) {
+	buffer := make([]byte, 9000)
+	for {
+		bytesReceived, src, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		var query dnsmessage.Message
+		err = query.Unpack(buffer[:bytesReceived])
+		if err != nil || query.Response {
+			continue
+		}
+
+		err = server.respond(conn, query, src)
+		if err != nil {
+			fmt.Printf("error answering mDNS query from %s: %s\n", src.String(), err.Error())
+		}
+	}
+}
+
+// respond answers whatever questions in the query are about us. One-shot queries
+// from ordinary ports, and questions that ask for it, get answered straight back.
+// Everyone else gets the answer on the group, so their neighbours can cache it
+func (server *MDNSServer) respond(conn *net.UDPConn, query dnsmessage.Message, src *net.UDPAddr) error {
+	legacy := src.Port != shared.MDNSPort
+	unicast := legacy
+	for _, question := range query.Questions {
+		if question.Class&shared.MDNSCacheFlushBit != 0 {
+			unicast = true
+		}
+	}
+
+	ttl := uint32(shared.MDNSTTL)
+	if legacy {
+		ttl = shared.MDNSLegacyTTL
+	}
+	answers, additionals := server.answer(query.Questions, ttl, !legacy)
+	if len(answers) == 0 {
+		return nil
+	}
+
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:      true,
+			Authoritative: true,
+		},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	// one-shot queriers match the answer up with their question
+	if legacy {
+		response.ID = query.ID
+		response.Questions = query.Questions
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return err
+	}
+
+	dst := src
+	if !unicast {
+		dst = server.group(conn, src.Zone)
+	}
+	_, err = conn.WriteToUDP(packed, dst)
+	return err
+}
+
+// answer finds the answers to the questions about us, along with the
+// records the asker is going to want next
+func (server *MDNSServer) answer(
+	questions []dnsmessage.Question,
+	ttl uint32,
+	cacheFlush bool,
+) ([]dnsmessage.Resource, []dnsmessage.Resource) {
+	service := server.service
+	addresses := service.AddressRecords(ttl, cacheFlush, localIPs())
+
+	var answers, additionals []dnsmessage.Resource
+	for _, question := range questions {
+		name := question.Name.String()
+		anyType := question.Type == dnsmessage.TypeALL
+
+		switch {
+		case strings.EqualFold(name, shared.MDNSServiceName()):
+			if question.Type == dnsmessage.TypePTR || anyType {
+				answers = append(answers, service.PTR(ttl))
+				additionals = append(additionals, service.SRV(ttl, cacheFlush), service.TXT(ttl, cacheFlush))
+				additionals = append(additionals, addresses...)
+			}
+		case strings.EqualFold(name, service.Instance()):
+			if question.Type == dnsmessage.TypeSRV || anyType {
+				answers = append(answers, service.SRV(ttl, cacheFlush))
+				additionals = append(additionals, addresses...)
+			}
+			if question.Type == dnsmessage.TypeTXT || anyType {
+				answers = append(answers, service.TXT(ttl, cacheFlush))
+			}
+		case strings.EqualFold(name, service.Host):
+			for _, address := range addresses {
+				if question.Type == address.Header.Type || anyType {
+					answers = append(answers, address)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, nil
+	}
+
+	return answers, additionals
+}
+
+// announce lets everyone on the group know we're here without being asked
+func (server *MDNSServer) announce(conn *net.UDPConn) {
+	service := server.service
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			Response:      true,
+			Authoritative: true,
+		},
+		Answers: append(
+			[]dnsmessage.Resource{
+				service.PTR(shared.MDNSTTL),
+				service.SRV(shared.MDNSTTL, true),
+				service.TXT(shared.MDNSTTL, true),
+			},
+			service.AddressRecords(shared.MDNSTTL, true, localIPs())...,
+		),
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		fmt.Printf("error announcing over mDNS: %s\n", err.Error())
+		return
+	}
+
+	if server.isIPv4(conn) {
+		conn.WriteToUDP(packed, server.group(conn, ""))
+		return
+	}
+	for _, ifi := range shared.MulticastInterfaces() {
+		conn.WriteToUDP(packed, server.group(conn, ifi.Name))
+	}
+}
+
+// group is the mDNS group for the connection. IPv6 link-local multicast
+// has to go out of a specific interface, which zone is
+func (server *MDNSServer) group(conn *net.UDPConn, zone string) *net.UDPAddr {
+	if server.isIPv4(conn) {
+		return &net.UDPAddr{IP: net.ParseIP(shared.MDNSGroupIPv4), Port: shared.MDNSPort}
+	}
+
+	return &net.UDPAddr{IP: net.ParseIP(shared.MDNSGroupIPv6), Port: shared.MDNSPort, Zone: zone}
+}
+
+func (server *MDNSServer) isIPv4(conn *net.UDPConn) bool {
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil
+}
+
+// localIPs are the addresses other machines can reach us on
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+
+	return ips
+}
@@ -0,0 +1,41 @@
+package server
+
+import "time"
+
+// Options are the options for a media server
+type Options struct {
+	// ServerPort is the port the audio server listens on
+	ServerPort int
+	// DiscoveryPort is the port the listener server listens for
+	// discovery and identification on
+	DiscoveryPort int
+	// PSK is the pre-shared key. When it's set, every session does a key
+	// exchange during identification and all audio is encrypted
+	PSK string
+	// AuthSecret is the secret every client signs auth challenges with,
+	// unless they have their own key in ClientKeys
+	AuthSecret string
+	// ClientKeys is a map of client name to the key that client signs
+	// auth challenges with. If neither this nor AuthSecret are set,
+	// clients don't need to authenticate
+	ClientKeys map[string]string
+	// Name is the name the server goes by. Empty means the host name
+	Name string
+	// TCPPort is the port the server takes clients that stream over
+	// TCP on, for networks that block UDP. 0 means it doesn't
+	TCPPort int
+	// WebSocketPort is the port the server takes clients that stream
+	// over WebSockets on. 0 means it doesn't
+	WebSocketPort int
+	// MDNS is whether the server advertises itself over mDNS
+	MDNS bool
+	// PacketDuration is how much of the mix goes in each packet back to
+	// clients. 0 means shared.DefaultPacketDuration. It's capped to what
+	// fits in a packet, see shared.PacketFrames
+	PacketDuration time.Duration
+	// AdminAddr is the address the admin API listens on, like
+	// 127.0.0.1:8890. With an AuthSecret, every request needs it as a
+	// bearer token. Without one, it has to be a loopback address.
+	// Empty means it's off
+	AdminAddr string
+}
@@ -7,6 +7,8 @@ import (
 	clientmanager "mediacenter/client_manager"
 	"mediacenter/shared"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/gen2brain/malgo"
@@ -16,20 +18,75 @@ import (
 type MediaServer struct {
 	serverPort    int
 	discoveryPort int
+	psk           string
+	// tcpPort and webSocketPort are where we take clients that
+	// can't use UDP. 0 means we don't
+	tcpPort       int
+	webSocketPort int
 	clients       clientmanager.ClientManager
 	listener      *ListenerServer
+	// mdns is nil when the server doesn't advertise itself over mDNS
+	mdns *MDNSServer
+	// adminAddr is where the admin API listens. Empty means it doesn't
+	adminAddr string
+	// adminSecret is the bearer token the admin API wants. Empty
+	// means it doesn't want one, and only listens on loopback
+	adminSecret string
+	// sessionCiphers is a map of session ID to the cipher for audio
+	// coming in from that session. The listener fills it in
+	sessionCiphers shared.ThreadSafeMap[uint32, shared.PacketCipher]
+	// conn is the audio server's connection. It's set before
+	// the audio device starts
+	conn *net.UDPConn
+	// streams is a map of address to the TCP and WebSocket
+	// connections clients stream over instead of UDP
+	streams shared.ThreadSafeMap[string, *shared.StreamConn]
+	// reidentifyRequests is a map of session ID to when we last told
+	// that session to identify again. reidentifyMu guards it
+	reidentifyRequests map[uint32]time.Time
+	reidentifyMu       sync.Mutex
+	// leaving is a map of session ID to the clients that said goodbye
+	// but still have audio fading out
+	leaving shared.ThreadSafeMap[uint32, clientmanager.Client]
+	// mixTime is when the audio callback is next expected, smoothed
+	// out. It's only touched by the audio callback
+	mixTime time.Time
+	// mixes are the mixes waiting to be sent back out to playback clients
+	mixes chan outgoingMix
 
 	isRunning bool
 }
 
 // NewMediaServer creates a new MediaServer
-func NewMediaServer(serverPort int, discoveryPort int, clientManager clientmanager.ClientManager) *MediaServer {
-	listenerServer := NewListenerServer(discoveryPort, serverPort, clientManager)
+func NewMediaServer(options Options, clientManager clientmanager.ClientManager) *MediaServer {
+	sessionCiphers := shared.NewThreadSafeMap[uint32, shared.PacketCipher](0)
+	// sessions that time out never say goodbye, so their ciphers
+	// go when the client manager gives up on them
+	clientManager.OnSessionEnd(func(sessionID uint32) {
+		sessionCiphers.Remove(sessionID)
+	})
+	listenerServer := NewListenerServer(options, clientManager, sessionCiphers)
+	var mdnsServer *MDNSServer
+	if options.MDNS {
+		mdnsServer = NewMDNSServer(options)
+	}
 	return &MediaServer{
-		serverPort:    serverPort,
-		discoveryPort: discoveryPort,
-		clients:       clientManager,
-		listener:      listenerServer,
+		serverPort:     options.ServerPort,
+		discoveryPort:  options.DiscoveryPort,
+		psk:            options.PSK,
+		tcpPort:        options.TCPPort,
+		webSocketPort:  options.WebSocketPort,
+		adminAddr:      options.AdminAddr,
+		adminSecret:    options.AuthSecret,
+		clients:        clientManager,
+		listener:       listenerServer,
+		mdns:           mdnsServer,
+		sessionCiphers: sessionCiphers,
+
+		streams:            shared.NewThreadSafeMap[string, *shared.StreamConn](0),
+		reidentifyRequests: make(map[uint32]time.Time),
+		leaving:            shared.NewThreadSafeMap[uint32, clientmanager.Client](0),
+		mixes:              make(chan outgoingMix, MixQueueLen),
 	}
 }
 
@@ -38,25 +95,47 @@ func (s *MediaServer) Start() (func() error, error) {
 	bgCtx := context.Background()
 	serverCtx, stopServer := context.WithCancel(bgCtx)
 
+	// the audio server needs to be up before the device, since the
+	// device sends the mix back out through it
+	err := s.launchServer(serverCtx)
+	if err != nil {
+		stopServer()
+		return nil, err
+	}
+	go s.sendMixes(serverCtx)
 	deviceCloser, err := shared.StartDevice(
 		"", // Not passing in a device name plays out of the default device
 		malgo.Playback,
+		shared.MixFormat,
 		s.handleAudio(),
 	)
 	if err != nil {
 		stopServer()
 		return nil, err
 	}
-	err = s.launchServer(serverCtx)
+	err = s.listener.Start(serverCtx)
 	if err != nil {
 		stopServer()
 		return nil, err
 	}
-	err = s.listener.Start(serverCtx)
+	err = s.startStreams(serverCtx)
+	if err != nil {
+		stopServer()
+		return nil, err
+	}
+	err = s.startAdmin(serverCtx)
 	if err != nil {
 		stopServer()
 		return nil, err
 	}
+	go s.sendPings(serverCtx)
+	if s.mdns != nil {
+		err = s.mdns.Start(serverCtx)
+		if err != nil {
+			stopServer()
+			return nil, err
+		}
+	}
 
 	closer := func() error {
 		if stopServer != nil {
@@ -86,40 +165,22 @@ func (s *MediaServer) launchServer(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	s.conn = server
 
 	go func() {
-		buffer := make([]byte, shared.NetworkPacketSizeBytes+shared.ClientAudioBytesHeaderLen)
+		buffer := make([]byte, shared.MaxParityPacketLen)
 		for {
 			if shared.ShouldKillCtx(ctx) {
 				return
 			}
 
-			bytesReceived, _, err := server.ReadFromUDP(buffer)
+			bytesReceived, srcAddr, err := server.ReadFromUDP(buffer)
 			if err != nil {
 				fmt.Printf("Error reading: %s\n", err.Error())
 				continue
 			}
 
-			header := buffer[:shared.ClientAudioBytesHeaderLen]
-
-			ok, sessionToken, err := shared.ReadClientBytesRequest(string(header))
-			if err != nil {
-				fmt.Printf("error reading message: %s\n", err.Error())
-				continue
-			}
-			if !ok {
-				continue
-			}
-
-			client, found := s.clients.GetClientBySessionToken(sessionToken)
-			if !found {
-				// TODO - reject client so they can reconnect
-				fmt.Printf("could not find client with session token %s\n", sessionToken)
-				continue
-			}
-			client.LastSeen = time.Now()
-			client.DataBuffer.Add(buffer[shared.ClientAudioBytesHeaderLen:bytesReceived]...)
-			s.clients.SetClient(client)
+			s.handlePacket(buffer[:bytesReceived], srcAddr, false)
 		}
 	}()
 
@@ -127,41 +188,260 @@ func (s *MediaServer) launchServer(ctx context.Context) error {
 	return nil
 }
 
-func (s *MediaServer) startUDP() (*net.UDPConn, error) {
-	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", s.serverPort))
+// handlePacket handles a packet that came in on the audio server, from any
+// transport. recovered is whether we rebuilt the packet from parity, in which
+// case it never made it across the network and doesn't count towards the
+// client's network stats
+func (s *MediaServer) handlePacket(packet []byte, srcAddr net.Addr, recovered bool) {
+	if !shared.IsAudioPacket(packet) {
+		err := s.handleControlMessage(string(packet), srcAddr)
+		if err != nil {
+			fmt.Printf("error handling control message from %s: %s\n", srcAddr.String(), err.Error())
+		}
+		return
+	}
+	if shared.IsParityPacket(packet) {
+		s.handleParity(packet, srcAddr)
+		return
+	}
+
+	header, payload, err := s.openPacket(packet)
+	if errors.Is(err, errUnknownSession) {
+		s.requestReidentify(header.SessionID, srcAddr, shared.RejectionReasonUnknownSession)
+		return
+	}
 	if err != nil {
-		return nil, err
+		fmt.Printf("error reading message: %s\n", err.Error())
+		return
+	}
+
+	client, found := s.clients.GetClientBySessionID(header.SessionID)
+	if !found {
+		fmt.Printf("could not find client with session ID %d\n", header.SessionID)
+		s.sessionCiphers.Remove(header.SessionID)
+		s.requestReidentify(header.SessionID, srcAddr, shared.RejectionReasonUnknownSession)
+		return
+	}
+	if !sameAddr(client.Addr, srcAddr) {
+		s.handleAddrMismatch(client, srcAddr)
+		return
+	}
+	if client.Status != clientmanager.ClientStatusConnected {
+		s.requestReidentify(header.SessionID, srcAddr, shared.RejectionReasonSessionExpired)
+		return
+	}
+	if header.Format != client.PayloadFormat {
+		fmt.Printf("unexpected payload format %s from %s\n", header.Format, client.Name)
+		return
+	}
+
+	// decoding always copies, so it's fine that the read buffer gets reused
+	samples, err := client.Codec.Decode(payload)
+	if err != nil {
+		fmt.Printf("error decoding audio from %s: %s\n", client.Name, err.Error())
+		return
+	}
+
+	// packets always hold whole frames, anything else would
+	// throw every channel after it out of line
+	if len(samples)%client.AudioFormat.Channels != 0 {
+		fmt.Printf("dropping audio from %s that ends partway through a frame\n", client.Name)
+		return
+	}
+
+	now := time.Now()
+	client.Stream.Push(header, samples, now)
+	client.LastSeen = now
+	if !recovered {
+		client.Network.RecordPacket(header.Sequence)
+	}
+	s.clients.SetClient(client)
+
+	if client.FEC != nil {
+		for _, rebuilt := range client.FEC.Add(header.Sequence, packet) {
+			s.handlePacket(rebuilt, srcAddr, true)
+		}
+	}
+}
+
+// handleParity handles an FEC parity packet. If it's enough to rebuild a packet
+// the client lost, the rebuilt packet is handled like it came in off the network
+func (s *MediaServer) handleParity(packet []byte, srcAddr net.Addr) {
+	// parity is sealed like audio is, and it's checked before we look at
+	// the session, so forged parity never gets near the session's decoder
+	header, opened, err := s.open(packet)
+	if err != nil {
+		return
+	}
+
+	client, found := s.clients.GetClientBySessionID(header.SessionID)
+	if !found || client.FEC == nil || client.Status != clientmanager.ClientStatusConnected {
+		return
+	}
+	if !sameAddr(client.Addr, srcAddr) {
+		return
 	}
 
-	return net.ListenUDP("udp4", addr)
+	rebuilt, ok := client.FEC.AddParity(opened)
+	if ok {
+		s.handlePacket(rebuilt, srcAddr, true)
+	}
+}
+
+// errUnknownSession is returned when a sealed packet is for a session we don't have a key for
+var errUnknownSession = errors.New("no session key for session")
+
+// openPacket decodes an audio packet. If we have a pre-shared key, the packet
+// has to be sealed by the session it claims to be from, otherwise it's dropped
+func (s *MediaServer) openPacket(packet []byte) (shared.AudioPacketHeader, []byte, error) {
+	header, opened, err := s.open(packet)
+	if err != nil {
+		return header, nil, err
+	}
+
+	return shared.DecodeAudioPacket(opened)
+}
+
+// open gives back a packet with its payload in the clear. If we have a
+// pre-shared key, the packet has to be sealed by the session it claims to be
+// from. If we don't, there's nothing to open and it comes back as it is
+func (s *MediaServer) open(packet []byte) (shared.AudioPacketHeader, []byte, error) {
+	header, _, err := shared.DecodeAudioPacket(packet)
+	if err != nil || s.psk == "" {
+		return header, packet, err
+	}
+
+	cipher, ok := s.sessionCiphers.Get(header.SessionID)
+	if !ok {
+		return header, nil, errUnknownSession
+	}
+
+	opened, err := cipher.Open(packet)
+	if err != nil {
+		return shared.AudioPacketHeader{}, nil, fmt.Errorf("unauthenticated packet for session ID %d: %w", header.SessionID, err)
+	}
+
+	return header, opened, nil
+}
+
+// startUDP starts the audio server on both IPv4 and IPv6 wherever the system can
+func (s *MediaServer) startUDP() (*net.UDPConn, error) {
+	return net.ListenUDP("udp", &net.UDPAddr{Port: s.serverPort})
 }
 
 func (s *MediaServer) handleAudio() shared.MalgoCallback {
 	return func(pOutput, _ []byte, _ uint32) {
-		bytesNeeded := len(pOutput)
+		output := shared.BytesToFloats(pOutput)
 		connectedClients := s.clients.ConnectedClients()
+		soloing := slices.ContainsFunc(connectedClients, func(client clientmanager.Client) bool {
+			return client.Mix.State().Solo
+		})
 
-		// we need to wait for at least 1 client to be ready to send
-		// audio
-		if len(connectedClients) == 0 {
+		// only mix in the clients whose jitter buffers are
+		// actually playing something
+		inputs := make([][]float32, 0, len(connectedClients))
+		for _, client := range connectedClients {
+			samples := make([]float32, len(output))
+			if client.Stream.ReadInto(samples) {
+				client.Mix.Ramp.Apply(samples, shared.MixFormat, client.Mix.State().Gain(soloing))
+				inputs = append(inputs, samples)
+			}
+		}
+		// clients that left keep playing until they've faded out
+		if s.leaving.Size() > 0 {
+			for sessionID, client := range s.leaving.Snapshot() {
+				samples := make([]float32, len(output))
+				if !client.Stream.ReadInto(samples) {
+					s.leaving.Remove(sessionID)
+					continue
+				}
+				client.Mix.Ramp.Apply(samples, shared.MixFormat, client.Mix.State().Gain(soloing))
+				inputs = append(inputs, samples)
+			}
+		}
+		if len(inputs) == 0 {
 			shared.ZeroSlice(pOutput)
 			return
 		}
 
-		readyClients := shared.FilterSlice(connectedClients, func(client clientmanager.Client) bool {
-			return client.DataBuffer.Size() >= shared.NetworkPacketSizeBytes/25 // this is pretty much trial/error
-		})
-		if len(readyClients) < 1 {
-			shared.ZeroSlice(pOutput)
+		mixed := MixFloats(inputs)
+		copy(output, mixed)
+		s.queueMix(mixed)
+	}
+}
+
+// outgoingMix is a mix on its way back out to the playback clients
+type outgoingMix struct {
+	samples      []float32
+	presentation time.Time
+}
+
+// queueMix hands the mix off to be sent back out to the playback clients. Encoding
+// and sending it takes too long to do in the audio callback, so it happens in
+// sendMixes. If that's fallen behind, the mix is dropped rather than holding up
+// the callback, and clients conceal it like any other lost audio
+func (s *MediaServer) queueMix(mix []float32) {
+	select {
+	case s.mixes <- outgoingMix{
+		samples:      mix,
+		presentation: s.presentationTime(len(mix) / shared.MixFormat.Channels),
+	}:
+	default:
+	}
+}
+
+// sendMixes sends every queued mix out to the playback clients until we shut down
+func (s *MediaServer) sendMixes(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case mix := <-s.mixes:
+			s.sendMix(mix)
+		}
+	}
+}
+
+// sendMix sends the full mix to every playback client. Clients that also record
+// hear themselves in it, same as everyone else in the room hears them
+func (s *MediaServer) sendMix(mix outgoingMix) {
+	for _, client := range s.clients.PlaybackClients() {
+		if client.Sender == nil || client.Addr == nil {
+			continue
+		}
+
+		samples := client.MixConverter.Convert(mix.samples)
+		// clients from before presentation times can't read packets that have them
+		var packets [][]byte
+		if client.ProtocolVersion >= shared.PresentationProtocolVersion {
+			packets = client.Sender.PacketizeAt(samples, mix.presentation)
+		} else {
+			packets = client.Sender.Packetize(samples)
 		}
 
-		audioBuffers := make([][]byte, len(readyClients))
-		for i, client := range readyClients {
-			audioBuffers[i] = client.DataBuffer.Read(bytesNeeded)
+		for _, packet := range packets {
+			err := s.writeTo(packet, *client.Addr)
+			if err != nil {
+				fmt.Printf("error sending audio to %s: %s\n", client.Name, err.Error())
+				break
+			}
 		}
+	}
+}
 
-		mixed := MixInputs(audioBuffers)
-		copy(pOutput, mixed)
+// presentationTime is when playback clients should play the mix we're sending out
+// now. Audio callbacks don't come in exactly on time, so it goes by when callbacks
+// come in smoothed out, instead of when this one did
+func (s *MediaServer) presentationTime(frames int) time.Time {
+	now := time.Now()
+	offset := now.Sub(s.mixTime)
+	if s.mixTime.IsZero() || offset > MixClockResyncThreshold || offset < -MixClockResyncThreshold {
+		s.mixTime = now
+	} else {
+		s.mixTime = s.mixTime.Add(offset / MixClockSmoothing)
 	}
+
+	presentation := s.mixTime.Add(PresentationDelay)
+	s.mixTime = s.mixTime.Add(shared.FramesDuration(frames, shared.MixFormat.SampleRate))
+	return presentation
 }
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mediacenter/shared"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// startStreams starts taking clients over TCP and WebSockets, for networks that
+// block UDP. Stream clients end up in the same client manager and mix as
+// everyone else, they just send the same packets down a stream
+func (s *MediaServer) startStreams(ctx context.Context) error {
+	if s.tcpPort != 0 {
+		err := s.startTCP(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if s.webSocketPort != 0 {
+		err := s.startWebSocket(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startTCP takes clients that stream over TCP
+func (s *MediaServer) startTCP(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.tcpPort))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Printf("error accepting TCP client: %s\n", err.Error())
+				continue
+			}
+
+			go s.serveStream(shared.NewStreamConn(conn, shared.StreamAddr{
+				Transport: shared.TransportTCP,
+				Addr:      conn.RemoteAddr().String(),
+			}))
+		}
+	}()
+
+	fmt.Printf("Taking TCP clients on port %d\n", s.tcpPort)
+	return nil
+}
+
+// startWebSocket takes clients that stream over WebSockets
+func (s *MediaServer) startWebSocket(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.webSocketPort))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(shared.WebSocketPath, websocket.Server{
+		// clients aren't browsers, so they don't send an origin
+		// to check. Sessions are authenticated on their own
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			// the connection is closed once the handler returns,
+			// so we serve the stream right here
+			s.serveStream(shared.NewStreamConn(ws, shared.StreamAddr{
+				Transport: shared.TransportWebSocket,
+				Addr:      ws.Request().RemoteAddr,
+			}))
+		},
+	})
+	httpServer := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+
+	go func() {
+		err := httpServer.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("WebSocket server stopped: %s\n", err.Error())
+		}
+	}()
+
+	fmt.Printf("Taking WebSocket clients on port %d\n", s.webSocketPort)
+	return nil
+}
+
+// serveStream handles everything a client sends down its stream until the stream
+// closes. Discovery and identification go to the listener, everything else is
+// handled like it came in over UDP
+func (s *MediaServer) serveStream(conn *shared.StreamConn) {
+	addr := conn.RemoteAddr()
+	s.streams.Set(addr.String(), conn)
+	defer func() {
+		s.streams.Remove(addr.String())
+		conn.Close()
+	}()
+	fmt.Printf("%s connected\n", addr.String())
+
+	buffer := make([]byte, shared.MaxStreamFrameLen)
+	for {
+		bytesReceived, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			fmt.Printf("%s disconnected\n", addr.String())
+			return
+		}
+
+		packet := buffer[:bytesReceived]
+		if shared.IdentifyServerAction(string(packet)) != shared.ServerActionUnknown {
+			s.listener.handleMessage(string(packet), conn, addr)
+			continue
+		}
+		s.handlePacket(packet, addr, false)
+	}
+}
+
+// writeTo sends a packet to a client, down its stream if it has one and
+// over UDP if it doesn't. Packets for streams that closed are dropped
+func (s *MediaServer) writeTo(packet []byte, addr net.Addr) error {
+	if _, ok := addr.(shared.StreamAddr); ok {
+		conn, ok := s.streams.Get(addr.String())
+		if !ok {
+			return nil
+		}
+		_, err := conn.WriteTo(packet, addr)
+		return err
+	}
+
+	_, err := s.conn.WriteTo(packet, addr)
+	return err
+}
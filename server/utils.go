@@ -2,17 +2,37 @@ package server
 
 import (
 	"mediacenter/shared"
-	"unsafe"
+	"os"
 )
 
+// serverName is the name the server goes by. It's the host
+// name unless the options give it one
+func serverName(options Options) string {
+	if options.Name != "" {
+		return options.Name
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return "mediacenter"
+	}
+	return name
+}
+
 // MixInputs mixes a group of inputs to a single output stream
 func MixInputs(ins [][]byte) []byte {
 	// To mix inputs, we'll need to do some basic addition, so
 	// we need to convert our bytes to their native float32 format
 	floats := shared.Map(ins, func(in []byte) []float32 {
-		return BytesToFloats(in)
+		return shared.BytesToFloats(in)
 	})
 
+	// Now convert the float back to bytes and we're golden
+	return shared.FloatsToBytes(MixFloats(floats))
+}
+
+// MixFloats mixes a group of float32 inputs to a single output stream
+func MixFloats(floats [][]float32) []float32 {
 	if len(floats) == 0 {
 		return nil
 	}
@@ -44,24 +64,5 @@ func MixInputs(ins [][]byte) []byte {
 		mixedFloats[i] = total
 	}
 
-	// Now convert the float back to bytes and we're golden
-	return FloatsToBytes(mixedFloats)
-}
-
-// BytesToFloats converts a byte slice to a float32 slice without copying.
-func BytesToFloats(b []byte) []float32 {
-	if len(b) == 0 {
-		return nil
-	}
-	// Divide length by 4 because float32 is 4 bytes
-	return unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), len(b)/4)
-}
-
-// FloatsToBytes converts a float32 slice to a byte slice without copying.
-func FloatsToBytes(f []float32) []byte {
-	if len(f) == 0 {
-		return nil
-	}
-	// Multiply length by 4 because each float32 is 4 bytes
-	return unsafe.Slice((*byte)(unsafe.Pointer(&f[0])), len(f)*4)
+	return mixedFloats
 }
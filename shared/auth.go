@@ -0,0 +1,40 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// SignAuthChallenge signs the server's challenge with the client's key. The
+// signature covers the client's name and key exchange public key too, so
+// neither can be swapped out by someone in the middle
+func SignAuthChallenge(key string, challenge []byte, identification ClientIdentification) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(challenge)
+	mac.Write([]byte(identification.Name))
+	mac.Write(identification.PublicKey)
+	return mac.Sum(nil)
+}
+
+// VerifyAuthChallenge checks the client's signature of the challenge
+func VerifyAuthChallenge(key string, challenge []byte, identification ClientIdentification) bool {
+	expected := SignAuthChallenge(key, challenge, identification)
+	return hmac.Equal(expected, identification.AuthSignature)
+}
+
+// SignRebind proves we own a session whose audio now comes from addr. It's keyed
+// with the session's rebind key, and covers the address the server saw so it
+// can't be replayed from anywhere else
+func SignRebind(key []byte, sessionID uint32, addr string, counter int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(binary.BigEndian.AppendUint32(nil, sessionID))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(counter)))
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)
+}
+
+// VerifyRebind checks a client's proof that it owns a session
+func VerifyRebind(key []byte, sessionID uint32, addr string, counter int64, proof []byte) bool {
+	return hmac.Equal(SignRebind(key, sessionID, addr, counter), proof)
+}
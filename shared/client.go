@@ -1 +1,88 @@
 package shared
+
+import "slices"
+
+// ClientIdentification is everything a client tells the server
+// about itself when it identifies
+type ClientIdentification struct {
+	// Name is the client's name
+	Name string
+	// Capabilities are the client's audio capabilities
+	Capabilities []ClientCapability
+	// PayloadFormats are the payload formats the client can send,
+	// in order of preference
+	PayloadFormats []PayloadFormat
+	// PublicKey is the client's side of the session key exchange.
+	// It's only sent when the client has a pre-shared key
+	PublicKey []byte
+	// AuthChallenge is the server's challenge the client is answering
+	AuthChallenge []byte
+	// AuthSignature is the client's signature of the challenge
+	AuthSignature []byte
+	// ProtocolVersions are the protocol versions the client speaks
+	ProtocolVersions ProtocolVersionRange
+	// AudioFormat is the format of the client's audio, both what it sends
+	// and what it plays. The server converts to and from its own
+	AudioFormat AudioFormat
+	// FECGroupSize is how many audio packets the client would like to send
+	// a parity packet for. It's 0 if the client doesn't want FEC
+	FECGroupSize int
+}
+
+// IdentificationResult is the server's response to a client identifying
+type IdentificationResult struct {
+	// OK is whether the client was accepted
+	OK bool
+	// SessionToken is the token for the client's session. It's
+	// empty under a pre-shared key, where it'd be sent in the clear
+	SessionToken string
+	// SessionID is the compact session ID the client puts in its audio packets
+	SessionID uint32
+	// PayloadFormat is the payload format the server picked for the client
+	PayloadFormat PayloadFormat
+	// PublicKey is the server's side of the session key exchange
+	PublicKey []byte
+	// KeyConfirmation proves the server derived the same session key
+	KeyConfirmation []byte
+	// Reason is why the client was rejected
+	Reason RejectionReason
+	// ProtocolVersion is the protocol version the server picked
+	ProtocolVersion int
+	// ProtocolVersions are the protocol versions the server speaks
+	ProtocolVersions ProtocolVersionRange
+	// FECGroupSize is how many audio packets the client should send a
+	// parity packet for. It's 0 if the server doesn't want any
+	FECGroupSize int
+}
+
+// DiscoveryResponse is the server's answer to a client looking for it
+type DiscoveryResponse struct {
+	// Port is the port of the server's audio server
+	Port int
+	// ProtocolVersions are the protocol versions the server speaks
+	ProtocolVersions ProtocolVersionRange
+	// ProtocolVersion is the protocol version the server picked for the client
+	ProtocolVersion int
+	// Reason is why the server won't take the client
+	Reason RejectionReason
+	// Name is the server's name
+	Name string
+	// ID tells servers apart, even ones with the same name. It's
+	// empty for servers from before servers had them
+	ID string
+}
+
+// HasCapability tells you if the client identified with the capability
+func (identification ClientIdentification) HasCapability(capability ClientCapability) bool {
+	return slices.Contains(identification.Capabilities, capability)
+}
+
+// ClientCapability is the capabilities a client has for audio
+type ClientCapability int
+
+const (
+	// ClientCapabilityRecord signals that a client can record audio
+	ClientCapabilityRecord ClientCapability = 1
+	// ClientCapabilityPlayback signals that a client can play audio
+	ClientCapabilityPlayback ClientCapability = 2
+)
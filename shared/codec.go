@@ -0,0 +1,290 @@
+package shared
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrUnsupportedPayloadFormat is returned when we don't have a codec
+	// for a payload format
+	ErrUnsupportedPayloadFormat = errors.New("unsupported payload format")
+	// ErrMalformedPayload is returned when a payload can't be decoded
+	ErrMalformedPayload = errors.New("malformed payload")
+)
+
+// Codec encodes and decodes interleaved float32 audio to and from packet payloads.
+// Encoders may carry state from one packet to the next, but every payload can be
+// decoded on its own so packets can be decoded in any order
+type Codec interface {
+	// Format is the payload format the codec produces
+	Format() PayloadFormat
+	// Encode encodes interleaved samples into a payload
+	Encode(samples []float32) []byte
+	// Decode decodes a payload into interleaved samples. The samples
+	// never share memory with the payload
+	Decode(payload []byte) ([]float32, error)
+	// MaxFrames is the most frames that fit in a payload of payloadLen bytes
+	MaxFrames(payloadLen int) int
+}
+
+// NewCodec creates a codec for the payload format
+func NewCodec(format PayloadFormat, channels int) (Codec, error) {
+	switch format {
+	case PayloadFormatFloat32:
+		return float32Codec{channels: channels}, nil
+	case PayloadFormatPCM16:
+		return pcm16Codec{channels: channels}, nil
+	case PayloadFormatIMAADPCM:
+		return newIMAADPCMCodec(channels), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedPayloadFormat, format)
+	}
+}
+
+// PickPayloadFormat picks the first format in preferred that is also in offered
+func PickPayloadFormat(preferred []PayloadFormat, offered []PayloadFormat) (PayloadFormat, bool) {
+	for _, format := range preferred {
+		for _, offer := range offered {
+			if format == offer {
+				return format, true
+			}
+		}
+	}
+
+	return PayloadFormatUnknown, false
+}
+
+// float32Codec passes interleaved little endian float32 samples through untouched
+type float32Codec struct {
+	channels int
+}
+
+func (float32Codec) Format() PayloadFormat { return PayloadFormatFloat32 }
+
+func (codec float32Codec) MaxFrames(payloadLen int) int {
+	return payloadLen / (4 * codec.channels)
+}
+
+func (float32Codec) Encode(samples []float32) []byte {
+	payload := make([]byte, len(samples)*4)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint32(payload[i*4:], math.Float32bits(sample))
+	}
+	return payload
+}
+
+func (float32Codec) Decode(payload []byte) ([]float32, error) {
+	if len(payload)%4 != 0 {
+		return nil, ErrMalformedPayload
+	}
+
+	samples := make([]float32, len(payload)/4)
+	for i := range samples {
+		samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(payload[i*4:]))
+	}
+	return samples, nil
+}
+
+// pcm16Codec is interleaved little endian signed 16 bit samples
+type pcm16Codec struct {
+	channels int
+}
+
+func (pcm16Codec) Format() PayloadFormat { return PayloadFormatPCM16 }
+
+func (codec pcm16Codec) MaxFrames(payloadLen int) int {
+	return payloadLen / (2 * codec.channels)
+}
+
+func (pcm16Codec) Encode(samples []float32) []byte {
+	payload := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(payload[i*2:], uint16(floatToInt16(sample)))
+	}
+	return payload
+}
+
+func (pcm16Codec) Decode(payload []byte) ([]float32, error) {
+	if len(payload)%2 != 0 {
+		return nil, ErrMalformedPayload
+	}
+
+	samples := make([]float32, len(payload)/2)
+	for i := range samples {
+		samples[i] = int16ToFloat(int16(binary.LittleEndian.Uint16(payload[i*2:])))
+	}
+	return samples, nil
+}
+
+// imaADPCMCodec is IMA ADPCM, 4 bits per sample. Each payload is laid out as:
+//
+//	frames (2) | per channel: predictor (2) + step index (1) + reserved (1) |
+//	4 bit codes, interleaved by channel, low nibble first
+//
+// The encoder carries its predictor from one packet to the next so there's no
+// step at packet boundaries, and the header lets each packet decode on its own
+type imaADPCMCodec struct {
+	channels int
+	states   []imaADPCMState
+}
+
+type imaADPCMState struct {
+	predictor int32
+	index     int32
+}
+
+func newIMAADPCMCodec(channels int) *imaADPCMCodec {
+	return &imaADPCMCodec{
+		channels: channels,
+		states:   make([]imaADPCMState, channels),
+	}
+}
+
+func (codec *imaADPCMCodec) Format() PayloadFormat { return PayloadFormatIMAADPCM }
+
+func (codec *imaADPCMCodec) headerLen() int {
+	return 2 + 4*codec.channels
+}
+
+// MaxFrames also stops at what the frame count in the header can hold
+func (codec *imaADPCMCodec) MaxFrames(payloadLen int) int {
+	return min((payloadLen-codec.headerLen())*2/codec.channels, math.MaxUint16)
+}
+
+func (codec *imaADPCMCodec) Encode(samples []float32) []byte {
+	frames := len(samples) / codec.channels
+	headerLen := codec.headerLen()
+	payload := make([]byte, headerLen+(frames*codec.channels+1)/2)
+
+	binary.BigEndian.PutUint16(payload[0:2], uint16(frames))
+	for channel, state := range codec.states {
+		offset := 2 + channel*4
+		binary.BigEndian.PutUint16(payload[offset:], uint16(int16(state.predictor)))
+		payload[offset+2] = byte(state.index)
+	}
+
+	for i, sample := range samples[:frames*codec.channels] {
+		state := &codec.states[i%codec.channels]
+		code := state.encode(int32(floatToInt16(sample)))
+		payload[headerLen+i/2] |= code << (4 * (i % 2))
+	}
+
+	return payload
+}
+
+func (codec *imaADPCMCodec) Decode(payload []byte) ([]float32, error) {
+	headerLen := codec.headerLen()
+	if len(payload) < headerLen {
+		return nil, ErrMalformedPayload
+	}
+
+	frames := int(binary.BigEndian.Uint16(payload[0:2]))
+	nSamples := frames * codec.channels
+	if len(payload) < headerLen+(nSamples+1)/2 {
+		return nil, ErrMalformedPayload
+	}
+
+	states := make([]imaADPCMState, codec.channels)
+	for channel := range states {
+		offset := 2 + channel*4
+		states[channel].predictor = int32(int16(binary.BigEndian.Uint16(payload[offset:])))
+		states[channel].index = min(max(int32(payload[offset+2]), 0), int32(len(imaStepTable)-1))
+	}
+
+	samples := make([]float32, nSamples)
+	for i := range samples {
+		code := (payload[headerLen+i/2] >> (4 * (i % 2))) & 0x0F
+		samples[i] = int16ToFloat(int16(states[i%codec.channels].decode(code)))
+	}
+
+	return samples, nil
+}
+
+// encode turns a sample into a 4 bit code and moves the state along
+func (state *imaADPCMState) encode(sample int32) byte {
+	step := imaStepTable[state.index]
+	difference := sample - state.predictor
+
+	var code byte
+	if difference < 0 {
+		code = 8
+		difference = -difference
+	}
+
+	delta := step >> 3
+	if difference >= step {
+		code |= 4
+		difference -= step
+		delta += step
+	}
+	step >>= 1
+	if difference >= step {
+		code |= 2
+		difference -= step
+		delta += step
+	}
+	step >>= 1
+	if difference >= step {
+		code |= 1
+		delta += step
+	}
+
+	state.advance(code, delta)
+	return code
+}
+
+// decode turns a 4 bit code back into a sample and moves the state along
+func (state *imaADPCMState) decode(code byte) int32 {
+	step := imaStepTable[state.index]
+	delta := step >> 3
+	if code&4 != 0 {
+		delta += step
+	}
+	if code&2 != 0 {
+		delta += step >> 1
+	}
+	if code&1 != 0 {
+		delta += step >> 2
+	}
+
+	state.advance(code, delta)
+	return state.predictor
+}
+
+func (state *imaADPCMState) advance(code byte, delta int32) {
+	if code&8 != 0 {
+		state.predictor -= delta
+	} else {
+		state.predictor += delta
+	}
+	state.predictor = min(max(state.predictor, math.MinInt16), math.MaxInt16)
+	state.index = min(max(state.index+imaIndexTable[code], 0), int32(len(imaStepTable)-1))
+}
+
+var imaIndexTable = [16]int32{
+	-1, -1, -1, -1, 2, 4, 6, 8,
+	-1, -1, -1, -1, 2, 4, 6, 8,
+}
+
+var imaStepTable = [89]int32{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17,
+	19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+	50, 55, 60, 66, 73, 80, 88, 97, 107, 118,
+	130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+	337, 371, 408, 449, 494, 544, 598, 658, 724, 796,
+	876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+	2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358,
+	5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+	15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767,
+}
+
+func floatToInt16(sample float32) int16 {
+	return int16(ClampFloat(sample, -1, 1) * math.MaxInt16)
+}
+
+func int16ToFloat(sample int16) float32 {
+	return float32(sample) / math.MaxInt16
+}
@@ -0,0 +1,115 @@
+package shared
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// sine is frames of interleaved audio with a different tone on every channel,
+// carrying on from frame start so consecutive calls join up
+func sine(start, frames, channels int) []float32 {
+	samples := make([]float32, frames*channels)
+	for frame := range frames {
+		for channel := range channels {
+			frequency := 440 * float64(channel+1)
+			phase := 2 * math.Pi * frequency * float64(start+frame) / AudioSampleRate
+			samples[frame*channels+channel] = float32(0.5 * math.Sin(phase))
+		}
+	}
+	return samples
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   PayloadFormat
+		channels int
+		frames   int
+		// maxError is the furthest any decoded sample can be from the original
+		maxError float64
+	}{
+		{name: "float32", format: PayloadFormatFloat32, channels: 2, frames: 240, maxError: 0},
+		{name: "pcm16", format: PayloadFormatPCM16, channels: 2, frames: 240, maxError: 1.0 / math.MaxInt16},
+		{name: "ima adpcm mono", format: PayloadFormatIMAADPCM, channels: 1, frames: 240, maxError: 0.01},
+		{name: "ima adpcm stereo", format: PayloadFormatIMAADPCM, channels: 2, frames: 240, maxError: 0.01},
+		{name: "ima adpcm odd frames", format: PayloadFormatIMAADPCM, channels: 1, frames: 239, maxError: 0.01},
+		{name: "ima adpcm odd frames stereo", format: PayloadFormatIMAADPCM, channels: 2, frames: 119, maxError: 0.01},
+		{name: "ima adpcm one frame", format: PayloadFormatIMAADPCM, channels: 1, frames: 1, maxError: 0.01},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder, err := NewCodec(test.format, test.channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder, err := NewCodec(test.format, test.channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the encoder carries its state from packet to packet, but
+			// every packet has to decode on its own, so they're decoded
+			// last to first with a decoder that never saw the encoder
+			const packets = 4
+			originals := make([][]float32, packets)
+			payloads := make([][]byte, packets)
+			// ADPCM starts from its smallest step and takes a few frames
+			// to catch up with loud audio, so that's left out
+			const warmUpFrames = 32
+			encoder.Encode(sine(0, warmUpFrames, test.channels))
+			for i := range packets {
+				originals[i] = sine(warmUpFrames+i*test.frames, test.frames, test.channels)
+				payloads[i] = encoder.Encode(originals[i])
+			}
+
+			for i := packets - 1; i >= 0; i-- {
+				decoded, err := decoder.Decode(payloads[i])
+				if err != nil {
+					t.Fatalf("decoding packet %d: %s", i, err)
+				}
+				if len(decoded) != len(originals[i]) {
+					t.Fatalf("packet %d decoded to %d samples, want %d", i, len(decoded), len(originals[i]))
+				}
+
+				var worst float64
+				for j, sample := range decoded {
+					worst = max(worst, math.Abs(float64(sample-originals[i][j])))
+				}
+				if worst > test.maxError {
+					t.Errorf("packet %d is off by up to %v, want at most %v", i, worst, test.maxError)
+				}
+			}
+		})
+	}
+}
+
+func TestCodecMalformedPayload(t *testing.T) {
+	mono := newIMAADPCMCodec(1)
+	stereo := newIMAADPCMCodec(2)
+	monoPayload := mono.Encode(sine(0, 239, 1))
+	stereoPayload := stereo.Encode(sine(0, 240, 2))
+
+	tests := []struct {
+		name    string
+		codec   Codec
+		payload []byte
+	}{
+		{name: "empty", codec: mono, payload: nil},
+		{name: "short header", codec: stereo, payload: stereoPayload[:stereo.headerLen()-1]},
+		{name: "missing the last code", codec: mono, payload: monoPayload[:len(monoPayload)-1]},
+		{name: "missing codes", codec: stereo, payload: stereoPayload[:len(stereoPayload)/2]},
+		{name: "pcm16 half a sample", codec: pcm16Codec{channels: 1}, payload: []byte{1, 2, 3}},
+		{name: "float32 half a sample", codec: float32Codec{channels: 1}, payload: []byte{1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.codec.Decode(test.payload)
+			if !errors.Is(err, ErrMalformedPayload) {
+				t.Errorf("got error %v, want %v", err, ErrMalformedPayload)
+			}
+		})
+	}
+}
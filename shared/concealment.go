@@ -0,0 +1,95 @@
+package shared
+
+// LossConcealer papers over holes in a stream of audio by repeating the last
+// audio it heard, fading it out if the hole goes on for too long
+type LossConcealer interface {
+	// Recover takes audio that actually arrived. If we were concealing,
+	// the start of it is crossfaded with the concealment so it doesn't click.
+	// It returns the audio to play
+	Recover(samples []float32) []float32
+	// Conceal makes up the given amount of frames of audio
+	Conceal(frames int) []float32
+	// Concealing tells you if the concealer is still making any sound
+	Concealing() bool
+}
+
+type lossConcealer struct {
+	channels int
+
+	// last is a copy of the last audio that actually arrived
+	last []float32
+	// position is where in last the next concealed sample comes from
+	position int
+	// concealedFrames is how long the current hole has gone on for
+	concealedFrames int
+}
+
+// NewLossConcealer creates a new loss concealer
+func NewLossConcealer(channels int) LossConcealer {
+	return &lossConcealer{
+		channels: channels,
+	}
+}
+
+func (lc *lossConcealer) Recover(samples []float32) []float32 {
+	if lc.concealedFrames > 0 && len(samples) > 0 {
+		// Fade from where the concealment would have gone next into
+		// the real audio
+		crossfadeFrames := min(ConcealmentCrossfadeFrames, len(samples)/lc.channels)
+		concealed := lc.Conceal(crossfadeFrames)
+		for frame := range crossfadeFrames {
+			in := float32(frame+1) / float32(crossfadeFrames+1)
+			for channel := range lc.channels {
+				i := frame*lc.channels + channel
+				samples[i] = samples[i]*in + concealed[i]*(1-in)
+			}
+		}
+	}
+
+	lc.last = append(lc.last[:0], samples...)
+	lc.position = 0
+	lc.concealedFrames = 0
+	return samples
+}
+
+func (lc *lossConcealer) Conceal(frames int) []float32 {
+	out := make([]float32, frames*lc.channels)
+	if len(lc.last) == 0 {
+		return out
+	}
+
+	for frame := range frames {
+		gain := lc.gain()
+		lc.concealedFrames++
+		if gain == 0 {
+			// we've faded all the way out, the rest is silence
+			break
+		}
+
+		for channel := range lc.channels {
+			out[frame*lc.channels+channel] = lc.last[lc.position] * gain
+			lc.position = (lc.position + 1) % len(lc.last)
+		}
+	}
+
+	return out
+}
+
+func (lc *lossConcealer) Concealing() bool {
+	return len(lc.last) > 0 && lc.gain() > 0
+}
+
+// gain is how loud the concealment should be at this point in the hole. We repeat
+// the last audio at full volume for a little while, then fade it out
+func (lc *lossConcealer) gain() float32 {
+	if lc.concealedFrames < ConcealmentHoldFrames {
+		return 1
+	}
+
+	fadedFrames := lc.concealedFrames - ConcealmentHoldFrames
+	if fadedFrames >= ConcealmentFadeFrames {
+		return 0
+	}
+
+	return 1 - float32(fadedFrames)/float32(ConcealmentFadeFrames)
+}
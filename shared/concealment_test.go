@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// constant is frames of mono audio that are all value
+func constant(frames int, value float32) []float32 {
+	samples := make([]float32, frames)
+	for i := range samples {
+		samples[i] = value
+	}
+	return samples
+}
+
+func TestLossConcealerFade(t *testing.T) {
+	concealer := NewLossConcealer(1)
+	concealer.Recover(constant(240, 1))
+	concealed := concealer.Conceal(ConcealmentHoldFrames + ConcealmentFadeFrames + 100)
+
+	tests := []struct {
+		name  string
+		frame int
+		gain  float32
+	}{
+		{name: "start of the hole", frame: 0, gain: 1},
+		{name: "end of the hold", frame: ConcealmentHoldFrames - 1, gain: 1},
+		{name: "start of the fade", frame: ConcealmentHoldFrames, gain: 1},
+		{name: "halfway through the fade", frame: ConcealmentHoldFrames + ConcealmentFadeFrames/2, gain: 0.5},
+		{name: "end of the fade", frame: ConcealmentHoldFrames + ConcealmentFadeFrames, gain: 0},
+		{name: "after the fade", frame: ConcealmentHoldFrames + ConcealmentFadeFrames + 99, gain: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if math.Abs(float64(concealed[test.frame]-test.gain)) > 1e-6 {
+				t.Errorf("frame %d is at %v, want %v", test.frame, concealed[test.frame], test.gain)
+			}
+		})
+	}
+
+	if concealer.Concealing() {
+		t.Error("still concealing after fading all the way out")
+	}
+}
+
+func TestLossConcealer(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels int
+		heard    []float32
+		frames   int
+		want     []float32
+	}{
+		{name: "nothing heard yet", channels: 1, heard: nil, frames: 3, want: []float32{0, 0, 0}},
+		{name: "repeats what it heard", channels: 1, heard: []float32{1, 2, 3}, frames: 5, want: []float32{1, 2, 3, 1, 2}},
+		{name: "keeps channels apart", channels: 2, heard: []float32{1, -1, 2, -2}, frames: 3, want: []float32{1, -1, 2, -2, 1, -1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			concealer := NewLossConcealer(test.channels)
+			if test.heard != nil {
+				concealer.Recover(slices.Clone(test.heard))
+			}
+			concealed := concealer.Conceal(test.frames)
+			if !slices.Equal(concealed, test.want) {
+				t.Errorf("concealed %v, want %v", concealed, test.want)
+			}
+		})
+	}
+}
+
+func TestLossConcealerCrossfade(t *testing.T) {
+	concealer := NewLossConcealer(1)
+	concealer.Recover(constant(240, 1))
+
+	// nothing was concealed, so audio comes through untouched
+	if recovered := concealer.Recover(constant(240, 0.5)); !slices.Equal(recovered, constant(240, 0.5)) {
+		t.Error("audio changed without anything being concealed")
+	}
+
+	concealer.Recover(constant(240, 1))
+	concealer.Conceal(100)
+	recovered := concealer.Recover(constant(240, 0))
+
+	// the concealment fades into the silence that arrived, one step at a time
+	for frame := 1; frame < ConcealmentCrossfadeFrames; frame++ {
+		if recovered[frame] >= recovered[frame-1] {
+			t.Fatalf("frame %d is at %v, not below the %v before it", frame, recovered[frame], recovered[frame-1])
+		}
+	}
+	if recovered[0] < 0.9 {
+		t.Errorf("crossfade starts at %v, want it close to the concealment", recovered[0])
+	}
+	if !slices.Equal(recovered[ConcealmentCrossfadeFrames:], constant(240-ConcealmentCrossfadeFrames, 0)) {
+		t.Error("audio after the crossfade was changed")
+	}
+}
+
+func TestAudioStreamConcealment(t *testing.T) {
+	const packetFrames = 240
+	tests := []struct {
+		name string
+		// packets are the packets that arrive, out of the packets up to the last one
+		packets []int
+		// heard and silent are frames that should have sound and be silent
+		heard  []int
+		silent []int
+		stats  StreamStats
+	}{
+		{
+			name:    "nothing lost",
+			packets: []int{0, 1, 2, 3, 4, 5},
+			heard:   []int{0, 3 * packetFrames},
+			stats:   StreamStats{JitterStats: JitterStats{Received: 6}},
+		},
+		{
+			name:    "one lost",
+			packets: []int{0, 1, 3, 4, 5},
+			heard:   []int{2 * packetFrames, 3*packetFrames - 1},
+			stats: StreamStats{
+				JitterStats:     JitterStats{Received: 5, Lost: 1},
+				LossEvents:      1,
+				ConcealedFrames: packetFrames,
+			},
+		},
+		{
+			name:    "two holes",
+			packets: []int{0, 1, 3, 4, 6, 7},
+			heard:   []int{2 * packetFrames, 5 * packetFrames},
+			stats: StreamStats{
+				JitterStats:     JitterStats{Received: 6, Lost: 2},
+				LossEvents:      2,
+				ConcealedFrames: 2 * packetFrames,
+			},
+		},
+		{
+			name:    "several lost in a row is one hole",
+			packets: []int{0, 1, 5, 6},
+			heard:   []int{2 * packetFrames, 2*packetFrames + ConcealmentHoldFrames - 1},
+			stats: StreamStats{
+				JitterStats:     JitterStats{Received: 4, Lost: 3},
+				LossEvents:      1,
+				ConcealedFrames: 3 * packetFrames,
+			},
+		},
+		{
+			name:    "long hole fades out",
+			packets: []int{0, 1, 12, 13},
+			heard:   []int{2 * packetFrames, 12 * packetFrames},
+			silent:  []int{2*packetFrames + ConcealmentHoldFrames + ConcealmentFadeFrames, 12*packetFrames - 1},
+			stats: StreamStats{
+				JitterStats:     JitterStats{Received: 4, Lost: 10},
+				LossEvents:      1,
+				ConcealedFrames: 10 * packetFrames,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := NewAudioStream(1, AudioSampleRate)
+			start := time.Now()
+			for _, index := range test.packets {
+				header := AudioPacketHeader{Sequence: uint32(index), Timestamp: uint64(index * packetFrames)}
+				stream.Push(header, constant(packetFrames, 0.5), start.Add(FramesDuration(index*packetFrames, AudioSampleRate)))
+			}
+
+			played := make([]float32, (test.packets[len(test.packets)-1]+1)*packetFrames)
+			for chunk := range slices.Chunk(played, packetFrames) {
+				stream.ReadInto(chunk)
+			}
+
+			for _, frame := range test.heard {
+				if played[frame] == 0 {
+					t.Errorf("frame %d is silent", frame)
+				}
+			}
+			for _, frame := range test.silent {
+				if played[frame] != 0 {
+					t.Errorf("frame %d is at %v, want silence", frame, played[frame])
+				}
+			}
+
+			stats := stream.Stats()
+			stats.JitterFrames = 0
+			stats.DepthFrames = 0
+			stats.TargetDepthFrames = 0
+			if stats != test.stats {
+				t.Errorf("stats are %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
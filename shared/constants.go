@@ -1,6 +1,9 @@
 package shared
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // Networking constants
 const (
@@ -11,9 +14,44 @@ const (
 	// different parts of a message on the server
 	ServerMessagePartsDelimiter = ";"
 	// ServerMessageItemDelimiter is the delimiter used within
-	// individual parts to further break the part down
-	// FIXME: i bet this becomes an issue at some point, ipv6?
+	// individual parts to further break the part down. Only the
+	// first one splits the key from the value, so values like
+	// IPv6 addresses can have it too
 	ServerMessageItemDelimiter = ":"
+	// DiscoveryMulticastGroup is the IPv6 link-local multicast group
+	// discovery requests go to alongside the IPv4 broadcast
+	DiscoveryMulticastGroup = "ff02::114"
+	// MDNSPort is the port mDNS runs on
+	MDNSPort = 5353
+	// MDNSGroupIPv4 is the IPv4 mDNS multicast group
+	MDNSGroupIPv4 = "224.0.0.251"
+	// MDNSGroupIPv6 is the IPv6 mDNS multicast group
+	MDNSGroupIPv6 = "ff02::fb"
+	// MDNSServiceType is the DNS-SD service type servers advertise themselves as
+	MDNSServiceType = "_jam._udp"
+	// MDNSDomain is the domain mDNS names live in
+	MDNSDomain = "local."
+	// MDNSTTL is how long, in seconds, other machines can cache our records
+	MDNSTTL = 120
+	// MDNSLegacyTTL is the most a record answered straight back to a
+	// one-shot query can be cached for, in seconds
+	MDNSLegacyTTL = 10
+	// MDNSCacheFlushBit is set in the class of records only we answer for,
+	// and in the class of questions that want a unicast answer
+	MDNSCacheFlushBit = 1 << 15
+	// MDNSTXTVersionKey is the TXT key for the protocol versions a server speaks
+	MDNSTXTVersionKey = "version"
+	// MDNSTXTNameKey is the TXT key for the server's name
+	MDNSTXTNameKey = "name"
+	// MDNSTXTAudioPortKey is the TXT key for the server's audio port
+	MDNSTXTAudioPortKey = "port"
+	// MinProtocolVersion is the oldest protocol version we still speak
+	MinProtocolVersion = 1
+	// MaxProtocolVersion is the newest protocol version we speak
+	MaxProtocolVersion = 2
+	// PresentationProtocolVersion is the first protocol version where
+	// the server says when its audio is meant to be played
+	PresentationProtocolVersion = 2
 	// ServerDiscoveryKeyword is the phrase used to distinguish
 	// server discovery messages on the network
 	ServerDiscoveryKeyword = "WHO_IS_MEDIA_SERVER"
@@ -26,25 +64,295 @@ const (
 	// ClientIdentificationResponse is the phrase used to distinguish
 	// client identification response from the server
 	ClientIdentificationResponse = "HI_CLIENT"
+	// SessionRebindRequiredKeyword is the phrase used to distinguish the server
+	// telling a client its audio is coming from an address it doesn't expect
+	SessionRebindRequiredKeyword = "REBIND_REQUIRED"
+	// SessionRebindKeyword is the phrase used to distinguish a client proving
+	// its session has moved to a new address
+	SessionRebindKeyword = "REBIND"
+	// SessionReidentifyKeyword is the phrase used to distinguish the server
+	// telling a client it doesn't have a session anymore and has to identify again
+	SessionReidentifyKeyword = "REIDENTIFY"
+	// HeartbeatKeyword is the phrase used to distinguish a client
+	// letting the server know it's still around
+	HeartbeatKeyword = "HEARTBEAT"
+	// HeartbeatAckKeyword is the phrase used to distinguish the server
+	// answering a client's heartbeat
+	HeartbeatAckKeyword = "HEARTBEAT_ACK"
+	// GoodbyeKeyword is the phrase used to distinguish a client
+	// telling the server it's leaving
+	GoodbyeKeyword = "GOODBYE"
+	// PingKeyword is the phrase used to distinguish the server
+	// measuring its link to a client
+	PingKeyword = "PING"
+	// PongKeyword is the phrase used to distinguish a client
+	// answering the server's ping
+	PongKeyword = "PONG"
+	// ControlSessionIDKey is the key for the session ID within control messages
+	ControlSessionIDKey = "SESSION_ID"
+	// ControlAddrKey is the key for an address within control messages
+	ControlAddrKey = "ADDR"
+	// ControlCounterKey is the key for a counter that has to go up with
+	// every message within control messages
+	ControlCounterKey = "COUNTER"
+	// ControlProofKey is the key for a proof of owning a session within
+	// control messages
+	ControlProofKey = "PROOF"
+	// ControlReasonKey is the key for the reason the server is
+	// turning a client away within control messages
+	ControlReasonKey = "REASON"
+	// ControlSentKey is the key for when the server sent a ping, in unix
+	// nanoseconds of its clock, within control messages
+	ControlSentKey = "SENT"
+	// ControlReceivedKey is the key for when the client got a ping, in
+	// unix nanoseconds of its clock, within control messages
+	ControlReceivedKey = "RECEIVED"
+	// ControlTransmitKey is the key for when the server answered a
+	// message, in unix nanoseconds of its clock, within control messages
+	ControlTransmitKey = "TRANSMIT"
+	// ControlSequenceKey is the key for the number of an authenticated
+	// control message. Each side numbers the messages it sends
+	ControlSequenceKey = "SEQUENCE"
+	// ControlMACKey is the key for the MAC of an authenticated control
+	// message. It's always the last item, and covers everything before it
+	ControlMACKey = "MAC"
+	// ClientAuthChallengeKeyword is the phrase used to distinguish
+	// the server challenging a client to authenticate
+	ClientAuthChallengeKeyword = "PROVE_IT"
+	// ProtocolVersionsKey is the key for the range of protocol
+	// versions a peer speaks, like "1-2"
+	ProtocolVersionsKey = "VERSIONS"
+	// ProtocolVersionKey is the key for the protocol version
+	// the server picked
+	ProtocolVersionKey = "VERSION"
+	// ServerNameKey is the key for the server's name in its discovery response
+	ServerNameKey = "SERVER_NAME"
+	// ServerIDKey is the key for the server's ID in its discovery response
+	ServerIDKey = "SERVER_ID"
 	// ClientIdentificationNameKey is the key for the 'name' item
 	// within a client identification message
 	ClientIdentificationNameKey = "NAME"
 	// ClientIdentificationCapabilitiesKey is the key for the
 	// 'capabilities' item within a client identification message
 	ClientIdentificationCapabilitiesKey = "CAPABILITIES"
-	// ClientAudioBytes is the audio bytes header
-	ClientAudioBytes = "AUDIO"
+	// ClientIdentificationPayloadFormatsKey is the key for the payload
+	// formats a client supports within a client identification message
+	ClientIdentificationPayloadFormatsKey = "FORMATS"
+	// ClientIdentificationPublicKeyKey is the key for the key exchange
+	// public key within client identification messages and responses
+	ClientIdentificationPublicKeyKey = "KEY"
+	// ClientIdentificationKeyConfirmationKey is the key for the server's
+	// session key confirmation within a client identification response
+	ClientIdentificationKeyConfirmationKey = "CONFIRM"
+	// ClientIdentificationChallengeKey is the key for the server's auth
+	// challenge within challenge and client identification messages
+	ClientIdentificationChallengeKey = "CHALLENGE"
+	// ClientIdentificationAuthKey is the key for the client's signature of
+	// the challenge within a client identification message
+	ClientIdentificationAuthKey = "AUTH"
+	// ClientIdentificationSampleRateKey is the key for the sample
+	// rate the client's audio is in
+	ClientIdentificationSampleRateKey = "SAMPLE_RATE"
+	// ClientIdentificationChannelsKey is the key for the channel
+	// count the client's audio is in
+	ClientIdentificationChannelsKey = "CHANNELS"
+	// ClientIdentificationFECKey is the key for how many packets go in each
+	// FEC group. The client offers it, and the server answers with what it took
+	ClientIdentificationFECKey = "FEC"
+	// ClientIdentificationReasonKey is the key for the reason a client
+	// was rejected within a client identification response
+	ClientIdentificationReasonKey = "REASON"
+	// ClientIdentificationSessionTokenKey is the key for the session
+	// token within a client identification response
+	ClientIdentificationSessionTokenKey = "SESSION_TOKEN"
+	// ClientIdentificationSessionIDKey is the key for the session ID
+	// within a client identification response
+	ClientIdentificationSessionIDKey = "SESSION_ID"
+	// ClientIdentificationPayloadFormatKey is the key for the payload
+	// format the server picked within a client identification response
+	ClientIdentificationPayloadFormatKey = "FORMAT"
+)
+
+// Audio packet constants
+const (
+	// AudioPacketMagic is the first byte of every audio packet. It's outside
+	// the ASCII range so it can't be confused with a text message
+	AudioPacketMagic = 0xA7
+	// AudioPacketVersion is the current version of the audio packet header
+	AudioPacketVersion = 1
+	// AudioPacketHeaderLen is the amount of bytes the audio packet header is
+	// magic (1) + version (1) + format (1) + flags (1) + session ID (4) +
+	// sequence (4) + timestamp (8) = 20
+	AudioPacketHeaderLen = 20
+	// AudioPacketFlagSealed is set in the header flags when the
+	// payload is encrypted
+	AudioPacketFlagSealed = 1 << 0
+	// AudioPacketFlagPresentation is set in the header flags when the
+	// payload starts with the packet's presentation time
+	AudioPacketFlagPresentation = 1 << 1
+	// AudioPacketFlagParity is set in the header flags when the packet is
+	// the FEC parity of a group of audio packets rather than audio itself
+	AudioPacketFlagParity = 1 << 2
+	// AudioPacketPresentationLen is how many bytes the presentation time
+	// at the start of the payload is
+	AudioPacketPresentationLen = 8
+	// AudioPacketSealOverhead is how many bytes sealing adds to a packet
+	AudioPacketSealOverhead = 16
+	// MaxAudioPacketLen is the largest an audio packet can get
+	MaxAudioPacketLen = AudioPacketHeaderLen + AudioPacketPresentationLen + NetworkPacketSizeBytes + AudioPacketSealOverhead
+)
+
+// Packetization constants
+const (
+	// DefaultPacketDuration is how much audio goes in each packet
+	// unless we're told otherwise
+	DefaultPacketDuration = SamplePeriodMilliseconds * time.Millisecond
+	// MaxPacketDuration is the most audio we'll put in one packet.
+	// Packets are capped to fit in a network packet on top of this
+	MaxPacketDuration = 20 * time.Millisecond
+)
+
+// Gain constants
+const (
+	// GainSmoothingTime is the time constant gain changes are eased in over
+	GainSmoothingTime = 5 * time.Millisecond
+	// GainSettledThreshold is how close a gain ramp has to get to
+	// its target before it just jumps the rest of the way
+	GainSettledThreshold = 1e-4
+)
 
-	// ClientAudioBytesHeaderLen is the amount of bytes the audio client bytes header is
-	// AUDIO (5) + ; (1) + UUID (36) + ; (1) = 43
-	ClientAudioBytesHeaderLen = 43
+// Forward error correction constants
+const (
+	// MaxFECGroupSize is the most audio packets one parity packet covers
+	MaxFECGroupSize = 16
+	// FECParityHeaderLen is the length of what a parity packet carries in
+	// front of the parity itself, which is group size (1) + length parity (2)
+	FECParityHeaderLen = 3
+	// MaxParityPacketLen is the largest a parity packet can get, since it
+	// has to be as long as the longest audio packet it covers, and then
+	// it's sealed itself
+	MaxParityPacketLen = AudioPacketHeaderLen + FECParityHeaderLen + MaxAudioPacketLen + AudioPacketSealOverhead
+	// FECWindowPackets is how many packets back we keep around to
+	// recover with. Anything still missing by then is lost for good
+	FECWindowPackets = 256
+)
+
+// Stream transport constants
+const (
+	// StreamFrameHeaderLen is the length of the header in front of
+	// every packet on a stream, which is the packet's length (2)
+	StreamFrameHeaderLen = 2
+	// MaxStreamFrameLen is the biggest packet a stream carries
+	MaxStreamFrameLen = 2048
+	// StreamFrameQueueLen is how many packets a stream holds
+	// on to before it stops reading
+	StreamFrameQueueLen = 256
+	// StreamSendQueueLen is how many packets a stream holds on
+	// to for a peer that's slow to read before dropping them
+	StreamSendQueueLen = 64
+	// StreamWriteTimeout is the longest a write to a stream can
+	// take before we give up on the stream
+	StreamWriteTimeout = 2 * time.Second
+	// StreamRedialDelay is how long we wait before trying to
+	// get a stream back after it breaks
+	StreamRedialDelay = time.Second
+	// WebSocketPath is the path servers take WebSockets on
+	WebSocketPath = "/jam"
+)
+
+// Encryption constants
+const (
+	// AuthChallengeLen is the length of the server's auth challenge
+	AuthChallengeLen = 32
+	// SessionKeyInfo is the HKDF info used to derive session keys
+	SessionKeyInfo = "jam session key v1"
+	// SessionKeyConfirmationInfo is what the server MACs with the session
+	// key to prove it derived the same one as the client
+	SessionKeyConfirmationInfo = "jam session key confirmation v1"
+	// SessionControlKeyInfo is the HKDF info used to derive the key
+	// control messages are authenticated with
+	SessionControlKeyInfo = "jam session control key v1"
+	// ControlReplayWindow is how far behind the newest control message
+	// from the other side an older one can be and still be taken
+	ControlReplayWindow = 64
+)
+
+// PayloadFormat is the format of the audio payload in an audio packet
+type PayloadFormat uint8
+
+const (
+	// PayloadFormatUnknown is an unknown payload format
+	PayloadFormatUnknown PayloadFormat = 0
+	// PayloadFormatFloat32 is interleaved little endian float32 samples
+	PayloadFormatFloat32 PayloadFormat = 1
+	// PayloadFormatPCM16 is interleaved little endian signed 16 bit samples
+	PayloadFormatPCM16 PayloadFormat = 2
+	// PayloadFormatIMAADPCM is 4 bit IMA ADPCM
+	PayloadFormatIMAADPCM PayloadFormat = 3
 )
 
+// SupportedPayloadFormats are the payload formats we have codecs for,
+// in order of preference. 16 bit PCM is first because it halves the
+// bandwidth of float32 without any audible difference
+var SupportedPayloadFormats = []PayloadFormat{
+	PayloadFormatPCM16,
+	PayloadFormatIMAADPCM,
+	PayloadFormatFloat32,
+}
+
+func (format PayloadFormat) String() string {
+	switch format {
+	case PayloadFormatFloat32:
+		return "float32"
+	case PayloadFormatPCM16:
+		return "pcm16"
+	case PayloadFormatIMAADPCM:
+		return "ima-adpcm"
+	default:
+		return "unknown"
+	}
+}
+
 var (
 	// ErrNotClientIdentificationMessage is returned when you know
 	ErrNotClientIdentificationMessage = errors.New("not identification message")
 )
 
+// RejectionReason is why the server refused to identify a client
+type RejectionReason string
+
+const (
+	// RejectionReasonBadRequest is when the identification message doesn't make sense
+	RejectionReasonBadRequest RejectionReason = "BAD_REQUEST"
+	// RejectionReasonNoCommonFormat is when the client and server don't
+	// share a payload format
+	RejectionReasonNoCommonFormat RejectionReason = "NO_COMMON_FORMAT"
+	// RejectionReasonKeyExchange is when the session key exchange fails
+	RejectionReasonKeyExchange RejectionReason = "KEY_EXCHANGE_FAILED"
+	// RejectionReasonServerFull is when the server can't take any more clients
+	RejectionReasonServerFull RejectionReason = "SERVER_FULL"
+	// RejectionReasonUnknownClient is when the server has no key for the client
+	RejectionReasonUnknownClient RejectionReason = "UNKNOWN_CLIENT"
+	// RejectionReasonChallengeExpired is when the client answers a challenge
+	// the server didn't send, or sent too long ago
+	RejectionReasonChallengeExpired RejectionReason = "CHALLENGE_EXPIRED"
+	// RejectionReasonAuthFailed is when the client's signature of the
+	// challenge is wrong
+	RejectionReasonAuthFailed RejectionReason = "AUTH_FAILED"
+	// RejectionReasonUnknownSession is when audio comes in for a session
+	// the server doesn't have, usually because it was cleaned up
+	RejectionReasonUnknownSession RejectionReason = "UNKNOWN_SESSION"
+	// RejectionReasonSessionExpired is when audio comes in for a session
+	// the server already marked as disconnected
+	RejectionReasonSessionExpired RejectionReason = "SESSION_EXPIRED"
+	// RejectionReasonUnsupportedVersion is when the client and server don't
+	// speak a protocol version in common
+	RejectionReasonUnsupportedVersion RejectionReason = "UNSUPPORTED_VERSION"
+	// RejectionReasonUnsupportedAudioFormat is when the client's audio is
+	// in a sample rate or channel count we can't handle
+	RejectionReasonUnsupportedAudioFormat RejectionReason = "UNSUPPORTED_AUDIO_FORMAT"
+)
+
 // ServerAction is the type of actions a client/server can take
 type ServerAction string
 
@@ -65,6 +373,90 @@ const (
 	NumOutputChannels        = 2
 	AudioSampleRate          = 48000
 	SamplePeriodMilliseconds = 5
+	// FloatFrameSizeBytes is the size of a single float32 frame
+	// across all output channels
+	FloatFrameSizeBytes = 4 * NumOutputChannels
+)
+
+// Audio format constants
+const (
+	// MinSampleRate and MaxSampleRate are the sample
+	// rates we take audio in
+	MinSampleRate = 8000
+	MaxSampleRate = 192000
+	// MaxChannels is the most channels we take audio in
+	MaxChannels = 8
+	// ResamplerTaps is how many frames on either side of an output
+	// frame the resampler's filter looks at, at the lower of the
+	// two sample rates
+	ResamplerTaps = 32
+	// ResamplerPhases is how many points between two input frames
+	// the resampler's filter is worked out at
+	ResamplerPhases = 256
+	// ResamplerCutoff is where the resampler's filter cuts off, as
+	// a fraction of the lower sample rate's nyquist. It's low enough
+	// that the filter's done rolling off by the time it gets to nyquist
+	ResamplerCutoff = 0.9
+)
+
+// Drift compensation constants
+const (
+	// DriftProportionalGain is how much a drift compensated stream speeds
+	// up for every second its jitter buffer is over its target depth
+	DriftProportionalGain = 0.05
+	// DriftIntegralGain is how quickly a drift compensated stream learns
+	// how far off the sender's clock is. It's picked so the stream
+	// settles without overshooting
+	DriftIntegralGain = DriftProportionalGain * DriftProportionalGain / 4
+	// DriftSmoothingSeconds is how long a drift compensated stream averages
+	// its jitter buffer's depth over, so single packets don't move it
+	DriftSmoothingSeconds = 1.0
+	// DriftMaxCorrection is the most a drift compensated stream speeds up
+	// or slows down. Sound cards are usually within 100ppm of each other
+	DriftMaxCorrection = 0.002
+)
+
+// Clock sync constants
+const (
+	// ClockSyncSamples is how many of the latest clock sync exchanges
+	// we pick the best out of
+	ClockSyncSamples = 8
+	// SyncMaxOffset is the furthest off its presentation times a synced
+	// stream lets itself drift before it jumps back in step, instead
+	// of slowly catching up
+	SyncMaxOffset = 5 * time.Millisecond
+)
+
+// Jitter buffer constants
+const (
+	// JitterBufferMinDepthFrames is the least amount of audio a jitter
+	// buffer holds before it starts playing (10ms)
+	JitterBufferMinDepthFrames = AudioSampleRate / 100
+	// JitterBufferMaxDepthFrames is the most audio a jitter buffer will
+	// hold before it starts throwing away the oldest packets (250ms)
+	JitterBufferMaxDepthFrames = AudioSampleRate / 4
+	// JitterBufferMaxPackets is how far ahead of the playout point a packet
+	// can be before we assume the sender restarted its stream
+	JitterBufferMaxPackets = 1024
+	// JitterBufferJitterMultiplier is how many times the measured jitter
+	// the buffer adds to its minimum depth
+	JitterBufferJitterMultiplier = 3
+)
+
+// Loss concealment constants
+const (
+	// ConcealmentHoldFrames is how long a hole in the audio is filled by
+	// repeating the last audio at full volume before fading it out (15ms)
+	ConcealmentHoldFrames = AudioSampleRate * 15 / 1000
+	// ConcealmentFadeFrames is how long concealment takes to fade to
+	// silence once it's held for too long (10ms)
+	ConcealmentFadeFrames = AudioSampleRate / 100
+	// ConcealmentCrossfadeFrames is how long the crossfade from concealment
+	// back into real audio is when the stream recovers (2ms)
+	ConcealmentCrossfadeFrames = AudioSampleRate * 2 / 1000
+	// StreamFadeOutFrames is how long a stream takes to fade to silence
+	// once its sender is gone (20ms)
+	StreamFadeOutFrames = AudioSampleRate * 20 / 1000
 )
 
 // MalgoCallback is the callback that gets passed to malgo
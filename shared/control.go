@@ -0,0 +1,240 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotControlMessage is returned when a message isn't a session control message
+var ErrNotControlMessage = errors.New("not a control message")
+
+// ControlMessage is a message about an existing session. Control messages go
+// over the same connection as the session's audio
+type ControlMessage struct {
+	// Keyword is what kind of control message this is
+	Keyword string
+	// SessionID is the session the message is about
+	SessionID uint32
+	// Items are the rest of the message's items
+	Items map[string]string
+}
+
+// CraftControlMessage puts together a control message. Items are key/value pairs
+func CraftControlMessage(keyword string, sessionID uint32, items ...string) []byte {
+	parts := []string{
+		keyword,
+		joinItems(ControlSessionIDKey, strconv.FormatUint(uint64(sessionID), 10)),
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		parts = append(parts, joinItems(items[i], items[i+1]))
+	}
+
+	return []byte(joinParts(parts...))
+}
+
+// ReadControlMessage reads a control message
+func ReadControlMessage(message string) (ControlMessage, error) {
+	parts := strings.Split(message, ServerMessagePartsDelimiter)
+	if !isControlKeyword(parts[0]) {
+		return ControlMessage{}, ErrNotControlMessage
+	}
+	items := readItems(parts[1:])
+
+	sessionID, err := strconv.ParseUint(items[ControlSessionIDKey], 10, 32)
+	if err != nil {
+		return ControlMessage{}, err
+	}
+	delete(items, ControlSessionIDKey)
+
+	return ControlMessage{
+		Keyword:   parts[0],
+		SessionID: uint32(sessionID),
+		Items:     items,
+	}, nil
+}
+
+// Int reads an item as an int64
+func (message ControlMessage) Int(key string) (int64, error) {
+	return strconv.ParseInt(message.Items[key], 10, 64)
+}
+
+// Time reads an item in unix nanoseconds as a time
+func (message ControlMessage) Time(key string) (time.Time, error) {
+	nanos, err := message.Int(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// EncodeControlTime encodes a time to go in a control message item
+func EncodeControlTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Bytes reads an item as bytes
+func (message ControlMessage) Bytes(key string) ([]byte, error) {
+	return decodeBytes(message.Items[key])
+}
+
+// EncodeControlBytes encodes bytes to go in a control message item
+func EncodeControlBytes(b []byte) string {
+	return encodeBytes(b)
+}
+
+func isControlKeyword(keyword string) bool {
+	switch keyword {
+	case SessionRebindRequiredKeyword,
+		SessionRebindKeyword,
+		SessionReidentifyKeyword,
+		HeartbeatKeyword,
+		HeartbeatAckKeyword,
+		GoodbyeKeyword,
+		PingKeyword,
+		PongKeyword:
+		return true
+	default:
+		return false
+	}
+}
+
+// ControlAuth authenticates a session's control messages with a key from the
+// session key exchange, so nobody without the pre-shared key can tell a client
+// to reconnect or a server to drop a client. Each side numbers the messages it
+// sends, and a message is only ever taken once, so they can't be replayed
+// either. A nil ControlAuth is for sessions without a pre-shared key, where
+// control messages aren't authenticated and anyone on the network can forge them
+type ControlAuth struct {
+	key []byte
+	// direction is the way the messages we send go
+	direction AudioDirection
+	sent      atomic.Uint64
+
+	mu sync.Mutex
+	// highest is the highest numbered message we've taken, and received
+	// has a bit set for every message we've taken up to ControlReplayWindow
+	// behind it, highest being the lowest bit
+	highest  uint64
+	received uint64
+}
+
+// NewControlAuth creates a control auth for control messages we send going in
+// direction, and the ones that come back the other way
+func NewControlAuth(key []byte, direction AudioDirection) *ControlAuth {
+	return &ControlAuth{
+		key:       key,
+		direction: direction,
+	}
+}
+
+// Craft puts together a control message like CraftControlMessage, then
+// numbers and MACs it
+func (auth *ControlAuth) Craft(keyword string, sessionID uint32, items ...string) []byte {
+	if auth == nil {
+		return CraftControlMessage(keyword, sessionID, items...)
+	}
+
+	message := CraftControlMessage(
+		keyword,
+		sessionID,
+		slices.Concat(items, []string{ControlSequenceKey, strconv.FormatUint(auth.sent.Add(1), 10)})...,
+	)
+	return []byte(joinParts(
+		string(message),
+		joinItems(ControlMACKey, encodeBytes(auth.mac(auth.direction, message))),
+	))
+}
+
+// Verify checks that a control message came from the other side of the session,
+// and that we haven't taken it before. Everything is fine without a key
+func (auth *ControlAuth) Verify(message string) bool {
+	if auth == nil {
+		return true
+	}
+
+	macPrefix := joinParts("", joinItems(ControlMACKey, ""))
+	macIndex := strings.LastIndex(message, macPrefix)
+	if macIndex < 0 {
+		return false
+	}
+	signed := message[:macIndex]
+	mac, err := decodeBytes(message[macIndex+len(macPrefix):])
+	if err != nil {
+		return false
+	}
+
+	direction := AudioDirectionToServer
+	if auth.direction == AudioDirectionToServer {
+		direction = AudioDirectionToClient
+	}
+	if !hmac.Equal(mac, auth.mac(direction, []byte(signed))) {
+		return false
+	}
+
+	control, err := ReadControlMessage(signed)
+	if err != nil {
+		return false
+	}
+	sequence, err := strconv.ParseUint(control.Items[ControlSequenceKey], 10, 64)
+	if err != nil {
+		return false
+	}
+	return auth.take(sequence)
+}
+
+// RebindKey is what rebinds of the session are proven with. Under a pre-shared
+// key, that's the key from the session key exchange, which never goes over the
+// network. Without one, all there is is the session token, which goes over the
+// network in the clear, so rebinding is only best effort: anyone who saw the
+// client identify can move its session
+func (auth *ControlAuth) RebindKey(sessionToken string) []byte {
+	if auth == nil {
+		return []byte(sessionToken)
+	}
+	return auth.key
+}
+
+// mac MACs a control message going in direction. The direction is in there so
+// a message can't be bounced back at whoever sent it
+func (auth *ControlAuth) mac(direction AudioDirection, message []byte) []byte {
+	mac := hmac.New(sha256.New, auth.key)
+	mac.Write([]byte{byte(direction)})
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// take marks a message number as taken. It's false if it already was, or it's
+// too far behind the newest to tell
+func (auth *ControlAuth) take(sequence uint64) bool {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+
+	if sequence == 0 {
+		return false
+	}
+	if sequence > auth.highest {
+		shift := sequence - auth.highest
+		if shift >= ControlReplayWindow {
+			auth.received = 0
+		} else {
+			auth.received <<= shift
+		}
+		auth.received |= 1
+		auth.highest = sequence
+		return true
+	}
+
+	age := auth.highest - sequence
+	if age >= ControlReplayWindow || auth.received&(1<<age) != 0 {
+		return false
+	}
+	auth.received |= 1 << age
+	return true
+}
@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestControlAuth(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client := NewControlAuth(key, AudioDirectionToServer)
+	server := NewControlAuth(key, AudioDirectionToClient)
+
+	first := string(client.Craft(HeartbeatKeyword, 5, ControlSentKey, "100"))
+	second := string(client.Craft(HeartbeatKeyword, 5, ControlSentKey, "200"))
+	third := string(client.Craft(GoodbyeKeyword, 5))
+
+	control, err := ReadControlMessage(first)
+	if err != nil {
+		t.Fatalf("reading authenticated message: %s", err)
+	}
+	if control.Keyword != HeartbeatKeyword || control.SessionID != 5 || control.Items[ControlSentKey] != "100" {
+		t.Errorf("authenticated message read as %+v", control)
+	}
+
+	tests := []struct {
+		name    string
+		auth    *ControlAuth
+		message string
+		want    bool
+	}{
+		{name: "in order", auth: server, message: second, want: true},
+		{name: "replayed", auth: server, message: second, want: false},
+		{name: "out of order", auth: server, message: first, want: true},
+		{name: "replayed out of order", auth: server, message: first, want: false},
+		{name: "unsigned", auth: server, message: string(CraftControlMessage(GoodbyeKeyword, 5)), want: false},
+		{name: "tampered", auth: server, message: strings.Replace(third, "SESSION_ID:5", "SESSION_ID:6", 1), want: false},
+		{name: "bounced back", auth: client, message: third, want: false},
+		{name: "wrong key", auth: NewControlAuth(bytes.Repeat([]byte{8}, 32), AudioDirectionToClient), message: third, want: false},
+		{name: "no key", auth: nil, message: string(CraftControlMessage(GoodbyeKeyword, 5)), want: true},
+		{name: "last", auth: server, message: third, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.auth.Verify(test.message); got != test.want {
+				t.Errorf("Verify(%q) = %t, want %t", test.message, got, test.want)
+			}
+		})
+	}
+}
+
+func TestControlAuthReplayWindow(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	client := NewControlAuth(key, AudioDirectionToServer)
+	server := NewControlAuth(key, AudioDirectionToClient)
+
+	old := string(client.Craft(PongKeyword, 1))
+	for range ControlReplayWindow {
+		if !server.Verify(string(client.Craft(PongKeyword, 1))) {
+			t.Fatal("rejected a fresh message")
+		}
+	}
+
+	// it's fallen out of the window, so there's no telling if we took it
+	if server.Verify(old) {
+		t.Error("took a message from before the replay window")
+	}
+}
@@ -0,0 +1,184 @@
+package shared
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	// ErrPacketNotSealed is returned when we expected a sealed packet
+	// but got one in the clear
+	ErrPacketNotSealed = errors.New("audio packet is not sealed")
+	// ErrKeyConfirmationFailed is returned when the server's key confirmation
+	// doesn't match the key we derived, which means our pre-shared keys differ
+	ErrKeyConfirmationFailed = errors.New("key confirmation failed, check the psk")
+)
+
+// AudioDirection is which way an audio packet is going. It's part of the
+// nonce so the two directions of a session never reuse one
+type AudioDirection byte
+
+const (
+	// AudioDirectionToServer is audio going from a client to the server
+	AudioDirectionToServer AudioDirection = 0
+	// AudioDirectionToClient is audio going from the server to a client
+	AudioDirectionToClient AudioDirection = 1
+)
+
+// PacketCipher seals and opens the audio packets going one way in a session
+type PacketCipher interface {
+	// Seal encrypts the payload of an encoded audio packet and
+	// authenticates its header
+	Seal(packet []byte) []byte
+	// Open checks and decrypts a sealed audio packet, returning
+	// the packet with its payload in the clear
+	Open(packet []byte) ([]byte, error)
+}
+
+type packetCipher struct {
+	aead      cipher.AEAD
+	direction AudioDirection
+}
+
+// NewPacketCipher creates a packet cipher for audio going in the given direction
+func NewPacketCipher(key []byte, direction AudioDirection) (PacketCipher, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &packetCipher{
+		aead:      aead,
+		direction: direction,
+	}, nil
+}
+
+func (pc *packetCipher) Seal(packet []byte) []byte {
+	header := packet[:AudioPacketHeaderLen]
+	header[3] |= AudioPacketFlagSealed
+
+	sealed := make([]byte, AudioPacketHeaderLen, len(packet)+AudioPacketSealOverhead)
+	copy(sealed, header)
+	return pc.aead.Seal(sealed, pc.nonce(header), packet[AudioPacketHeaderLen:], header)
+}
+
+func (pc *packetCipher) Open(packet []byte) ([]byte, error) {
+	if len(packet) < AudioPacketHeaderLen {
+		return nil, ErrAudioPacketTooShort
+	}
+
+	header := packet[:AudioPacketHeaderLen]
+	if header[3]&AudioPacketFlagSealed == 0 {
+		return nil, ErrPacketNotSealed
+	}
+
+	opened := make([]byte, AudioPacketHeaderLen, len(packet))
+	copy(opened, header)
+	return pc.aead.Open(opened, pc.nonce(header), packet[AudioPacketHeaderLen:], header)
+}
+
+// nonce builds the nonce out of the packet's direction, sequence number, and
+// timestamp. The sequence number would take months to wrap around, and the
+// timestamp would have to wrap around with it for a nonce to repeat. Parity
+// packets have the same sequence number and timestamp as the first packet
+// they cover, so they're marked apart
+func (pc *packetCipher) nonce(header []byte) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	nonce[0] = byte(pc.direction)
+	if header[3]&AudioPacketFlagParity != 0 {
+		nonce[1] = 1
+	}
+	copy(nonce[4:8], header[8:12])
+	binary.BigEndian.PutUint32(nonce[8:12], uint32(binary.BigEndian.Uint64(header[12:20])))
+	return nonce
+}
+
+// SessionCiphers are the packet ciphers for both directions of a session
+type SessionCiphers struct {
+	// ToServer is for audio going from the client to the server
+	ToServer PacketCipher
+	// ToClient is for audio going from the server to the client
+	ToClient PacketCipher
+	// Confirmation proves to the client that the server derived the same key
+	Confirmation []byte
+	// ControlKey authenticates the session's control messages
+	ControlKey []byte
+}
+
+// ControlAuth is what authenticates the control messages we send, going in
+// direction, and the ones the other side sends back. It's nil when the
+// session isn't encrypted, and control messages go unauthenticated
+func (ciphers SessionCiphers) ControlAuth(direction AudioDirection) *ControlAuth {
+	if ciphers.ControlKey == nil {
+		return nil
+	}
+	return NewControlAuth(ciphers.ControlKey, direction)
+}
+
+// GenerateKeyExchangeKey generates a new ephemeral key for the session key exchange
+func GenerateKeyExchangeKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// DeriveSessionCiphers derives the session ciphers from our side of the key exchange,
+// the peer's public key, and the pre-shared key. Mixing in the pre-shared key means
+// someone in the middle of the exchange can't derive the same session key
+func DeriveSessionCiphers(private *ecdh.PrivateKey, peerPublicKey []byte, psk string) (SessionCiphers, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+
+	key, err := hkdf.Key(sha256.New, secret, []byte(psk), SessionKeyInfo, chacha20poly1305.KeySize)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+
+	toServer, err := NewPacketCipher(key, AudioDirectionToServer)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+	toClient, err := NewPacketCipher(key, AudioDirectionToClient)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+
+	// control messages get their own key, so nothing MACed with it
+	// can ever be mistaken for something sealed with the session key
+	controlKey, err := hkdf.Key(sha256.New, secret, []byte(psk), SessionControlKeyInfo, sha256.Size)
+	if err != nil {
+		return SessionCiphers{}, err
+	}
+
+	confirmation := hmac.New(sha256.New, key)
+	confirmation.Write([]byte(SessionKeyConfirmationInfo))
+
+	return SessionCiphers{
+		ToServer:     toServer,
+		ToClient:     toClient,
+		Confirmation: confirmation.Sum(nil),
+		ControlKey:   controlKey,
+	}, nil
+}
+
+// ConfirmSessionCiphers checks the server's key confirmation against our ciphers
+func ConfirmSessionCiphers(ciphers SessionCiphers, confirmation []byte) error {
+	if !hmac.Equal(ciphers.Confirmation, confirmation) {
+		return ErrKeyConfirmationFailed
+	}
+
+	return nil
+}
@@ -7,14 +7,14 @@ import (
 	"github.com/gen2brain/malgo"
 )
 
-// MalgoConfig creates the Malgo configuration
-func MalgoConfig(deviceID *malgo.DeviceID, deviceType malgo.DeviceType) malgo.DeviceConfig {
+// MalgoConfig creates the Malgo configuration for a device running in format
+func MalgoConfig(deviceID *malgo.DeviceID, deviceType malgo.DeviceType, format AudioFormat) malgo.DeviceConfig {
 	deviceConfig := malgo.DefaultDeviceConfig(malgo.Duplex)
 	deviceConfig.Capture.Format = malgo.FormatF32
-	deviceConfig.Capture.Channels = NumInputChannels
+	deviceConfig.Capture.Channels = uint32(format.Channels)
 	deviceConfig.Playback.Format = malgo.FormatF32
-	deviceConfig.Playback.Channels = NumOutputChannels
-	deviceConfig.SampleRate = AudioSampleRate
+	deviceConfig.Playback.Channels = uint32(format.Channels)
+	deviceConfig.SampleRate = uint32(format.SampleRate)
 	deviceConfig.Alsa.NoMMap = 1
 	deviceConfig.PeriodSizeInMilliseconds = SamplePeriodMilliseconds
 
@@ -70,10 +70,11 @@ func BuildDeviceKiller(ctx *malgo.AllocatedContext, device *malgo.Device) func()
 	}
 }
 
-// StartDevice starts an audio device
+// StartDevice starts an audio device running in format
 func StartDevice(
 	deviceName string,
 	deviceType malgo.DeviceType,
+	format AudioFormat,
 	callback func([]byte, []byte, uint32),
 ) (func() error, error) {
 	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
@@ -90,7 +91,7 @@ func StartDevice(
 		deviceIDPtr = &deviceID
 	}
 
-	deviceConfig := MalgoConfig(deviceIDPtr, deviceType)
+	deviceConfig := MalgoConfig(deviceIDPtr, deviceType, format)
 	deviceCallbacks := malgo.DeviceCallbacks{
 		Data: callback,
 	}
@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// driftController works out how much faster or slower to play a stream so some
+// error stays at 0. It's a PI controller, and the integral ends up being however
+// far off the sender's clock is from ours. It's only touched by the reader
+type driftController struct {
+	error    float64
+	hasError bool
+	integral float64
+}
+
+// update takes the latest error, in seconds, after playing for elapsed seconds, and
+// gives back how much faster to play. The error is smoothed out first, so no single
+// packet moves it much
+func (controller *driftController) update(err, elapsed float64) float64 {
+	if !controller.hasError {
+		controller.error = err
+		controller.hasError = true
+	}
+	controller.error += (err - controller.error) * min(1, elapsed/DriftSmoothingSeconds)
+
+	controller.integral += DriftIntegralGain * controller.error * elapsed
+	controller.integral = math.Min(math.Max(controller.integral, -DriftMaxCorrection), DriftMaxCorrection)
+	correction := DriftProportionalGain*controller.error + controller.integral
+	return math.Min(math.Max(correction, -DriftMaxCorrection), DriftMaxCorrection)
+}
+
+// reset forgets the error, for when the stream starts over. The clock is
+// still off by as much, so we keep the integral
+func (controller *driftController) reset() {
+	controller.hasError = false
+}
+
+// driftStream plays a stream from a sender whose sound card runs on its own
+// clock. No two clocks run at exactly the same rate, so left alone the jitter
+// buffer slowly drains or fills up. We keep an eye on how full it is, and nudge
+// the rate we play it at so it stays at its target depth
+type driftStream struct {
+	AudioStream
+	from      AudioFormat
+	to        AudioFormat
+	converter *FormatConverter
+	// nominalRatio is the resampling ratio if both clocks were perfect
+	nominalRatio float64
+	controller   driftController
+	// drift is the controller's integral in ppm, as float64 bits, so Stats can read it
+	drift atomic.Uint64
+}
+
+// NewDriftCompensatedStream wraps a stream pushed in one format so it plays in another,
+// at whatever rate keeps its jitter buffer at its target depth
+func NewDriftCompensatedStream(stream AudioStream, from, to AudioFormat) AudioStream {
+	converter := NewFormatConverter(from, to)
+	if converter.resampler == nil {
+		// even at the same sample rate, we need a resampler to nudge the rate with
+		converter.resampler = NewResampler(converter.resampleChannels(), from.SampleRate, to.SampleRate)
+	}
+
+	return &driftStream{
+		AudioStream:  stream,
+		from:         from,
+		to:           to,
+		converter:    converter,
+		nominalRatio: converter.resampler.Ratio(),
+	}
+}
+
+func (stream *driftStream) ReadInto(target []float32) bool {
+	played := stream.converter.Read(target, stream.AudioStream.ReadInto)
+	if !played {
+		// the buffer starts over at its target depth once it's playing again
+		stream.controller.reset()
+		return false
+	}
+
+	stream.adjust(len(target) / stream.to.Channels)
+	return true
+}
+
+// adjust nudges the rate we play at after playing frames, to keep the
+// jitter buffer at its target depth
+func (stream *driftStream) adjust(frames int) {
+	stats := stream.AudioStream.Stats()
+	depthError := float64(stats.DepthFrames-stats.TargetDepthFrames) / float64(stream.from.SampleRate)
+	elapsed := float64(frames) / float64(stream.to.SampleRate)
+	correction := stream.controller.update(depthError, elapsed)
+
+	// a sender running fast fills the buffer up, so we play
+	// a little more of its audio for every frame of ours
+	stream.converter.resampler.SetRatio(stream.nominalRatio * (1 + correction))
+	stream.drift.Store(math.Float64bits(stream.controller.integral * 1e6))
+}
+
+func (stream *driftStream) Stats() StreamStats {
+	stats := stream.AudioStream.Stats()
+	stats.DriftPPM = math.Float64frombits(stream.drift.Load())
+	return stats
+}
@@ -0,0 +1,315 @@
+package shared
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Forward error correction works on groups of audio packets. After every group
+// the sender sends a parity packet, which is every packet in the group XORed
+// together. If one packet in the group goes missing, XORing the parity with the
+// rest of the group gets it back. Parity covers whole packets as they went out
+// on the network, sealing and all, so a recovered packet is opened and checked
+// just like any other. Parity packets are sealed on top of that, so nobody can
+// forge one to throw off the decoder.
+//
+// The payload of a parity packet (big endian) is:
+//
+//	group size (1) | XOR of the packets' lengths (2) | XOR of the packets
+//
+// where shorter packets are padded out with zeros. The header's sequence and
+// timestamp are those of the first packet in the group
+
+// FECStats is how forward error correction is doing for a stream
+type FECStats struct {
+	// Recovered is how many lost packets were rebuilt from parity
+	Recovered uint64 `json:"recovered"`
+	// Unrecoverable is how many lost packets couldn't be rebuilt
+	Unrecoverable uint64 `json:"unrecoverable"`
+}
+
+// IsParityPacket tells you if the message looks like an FEC parity packet
+func IsParityPacket(message []byte) bool {
+	return IsAudioPacket(message) && len(message) >= AudioPacketHeaderLen && message[3]&AudioPacketFlagParity != 0
+}
+
+// EncodeParityPacket puts together the parity packet for a group of audio packets
+func EncodeParityPacket(group [][]byte) []byte {
+	first, _, _ := DecodeAudioPacket(group[0])
+
+	longest := 0
+	for _, packet := range group {
+		longest = max(longest, len(packet))
+	}
+
+	payload := make([]byte, FECParityHeaderLen+longest)
+	payload[0] = byte(len(group))
+	var lengths uint16
+	for _, packet := range group {
+		lengths ^= uint16(len(packet))
+		xorInto(payload[FECParityHeaderLen:], packet)
+	}
+	binary.BigEndian.PutUint16(payload[1:3], lengths)
+
+	return EncodeAudioPacket(AudioPacketHeader{
+		Format:    first.Format,
+		Flags:     AudioPacketFlagParity,
+		SessionID: first.SessionID,
+		Sequence:  first.Sequence,
+		Timestamp: first.Timestamp,
+	}, payload)
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+type fecSender struct {
+	AudioSender
+	// cipher seals the parity packets. It's nil when
+	// the session isn't encrypted
+	cipher    PacketCipher
+	groupSize int
+	group     [][]byte
+}
+
+// NewFECSender wraps a sender so a parity packet follows every groupSize packets
+// it makes. If cipher isn't nil, every parity packet is sealed with it
+func NewFECSender(sender AudioSender, cipher PacketCipher, groupSize int) AudioSender {
+	return &fecSender{
+		AudioSender: sender,
+		cipher:      cipher,
+		groupSize:   groupSize,
+	}
+}
+
+func (sender *fecSender) Packetize(samples []float32) [][]byte {
+	return sender.protect(sender.AudioSender.Packetize(samples))
+}
+
+func (sender *fecSender) PacketizeAt(samples []float32, presentation time.Time) [][]byte {
+	return sender.protect(sender.AudioSender.PacketizeAt(samples, presentation))
+}
+
+// protect adds parity packets in after every group that's filled up. Groups
+// carry over between calls, so they don't care how the audio's split up
+func (sender *fecSender) protect(packets [][]byte) [][]byte {
+	protected := make([][]byte, 0, len(packets)+len(packets)/sender.groupSize+1)
+	for _, packet := range packets {
+		protected = append(protected, packet)
+		sender.group = append(sender.group, packet)
+		if len(sender.group) == sender.groupSize {
+			parity := EncodeParityPacket(sender.group)
+			if sender.cipher != nil {
+				parity = sender.cipher.Seal(parity)
+			}
+			protected = append(protected, parity)
+			sender.group = sender.group[:0]
+		}
+	}
+	return protected
+}
+
+// parityGroup is a parity packet we couldn't use yet
+type parityGroup struct {
+	first   uint32
+	size    int
+	lengths uint16
+	parity  []byte
+}
+
+// FECDecoder rebuilds lost audio packets from parity packets. It isn't thread
+// safe, it's meant to be fed by whatever's reading the stream's packets.
+// Stats is the exception, that's safe to call from anywhere
+type FECDecoder struct {
+	// packets are the packets that came in recently, by sequence
+	packets map[uint32][]byte
+	// parities are the parity packets still waiting on more of
+	// their group, by the sequence of the group's first packet
+	parities map[uint32]parityGroup
+	// missing are the sequences we know were sent but haven't seen
+	missing map[uint32]struct{}
+	highest uint32
+	started bool
+
+	recovered     atomic.Uint64
+	unrecoverable atomic.Uint64
+}
+
+// NewFECDecoder creates a new FEC decoder
+func NewFECDecoder() *FECDecoder {
+	return &FECDecoder{
+		packets:  make(map[uint32][]byte),
+		parities: make(map[uint32]parityGroup),
+		missing:  make(map[uint32]struct{}),
+	}
+}
+
+// Add keeps hold of an audio packet that came in, in case it's needed to
+// rebuild another. It gives back any packets it let us rebuild
+func (decoder *FECDecoder) Add(sequence uint32, packet []byte) [][]byte {
+	if _, ok := decoder.packets[sequence]; ok {
+		return nil
+	}
+	decoder.store(sequence, append([]byte(nil), packet...))
+
+	// a parity packet that was waiting on this one might be enough now
+	var recovered [][]byte
+	for first, group := range decoder.parities {
+		offset := SequenceDistance(first, sequence)
+		if offset < 0 || offset >= group.size {
+			continue
+		}
+		rebuilt, ok := decoder.recover(group)
+		if ok {
+			recovered = append(recovered, rebuilt)
+			delete(decoder.parities, first)
+		}
+	}
+	return recovered
+}
+
+// AddParity takes in a parity packet. If its group is missing exactly one
+// packet, that packet is rebuilt and given back
+func (decoder *FECDecoder) AddParity(packet []byte) ([]byte, bool) {
+	header, payload, err := DecodeAudioPacket(packet)
+	if err != nil || len(payload) < FECParityHeaderLen {
+		return nil, false
+	}
+	group := parityGroup{
+		first:   header.Sequence,
+		size:    int(payload[0]),
+		lengths: binary.BigEndian.Uint16(payload[1:3]),
+		parity:  append([]byte(nil), payload[FECParityHeaderLen:]...),
+	}
+	if group.size == 0 || group.size > MaxFECGroupSize {
+		return nil, false
+	}
+
+	// the parity tells us the whole group was sent, even if
+	// the last of it hasn't shown up
+	decoder.track(group.first + uint32(group.size) - 1)
+
+	rebuilt, ok := decoder.recover(group)
+	if !ok && decoder.missingFrom(group) > 1 {
+		decoder.parities[group.first] = group
+	}
+	return rebuilt, ok
+}
+
+// Stats is how many lost packets have been recovered and how many couldn't be
+func (decoder *FECDecoder) Stats() FECStats {
+	if decoder == nil {
+		return FECStats{}
+	}
+	return FECStats{
+		Recovered:     decoder.recovered.Load(),
+		Unrecoverable: decoder.unrecoverable.Load(),
+	}
+}
+
+// missingFrom is how many of a group's packets we don't have
+func (decoder *FECDecoder) missingFrom(group parityGroup) int {
+	missing := 0
+	for i := range group.size {
+		if _, ok := decoder.packets[group.first+uint32(i)]; !ok {
+			missing++
+		}
+	}
+	return missing
+}
+
+// recover rebuilds the one packet a group is missing. It's
+// false if the group isn't missing exactly one
+func (decoder *FECDecoder) recover(group parityGroup) ([]byte, bool) {
+	if decoder.missingFrom(group) != 1 {
+		return nil, false
+	}
+
+	var sequence uint32
+	lengths := group.lengths
+	rebuilt := append([]byte(nil), group.parity...)
+	for i := range group.size {
+		packet, ok := decoder.packets[group.first+uint32(i)]
+		if !ok {
+			sequence = group.first + uint32(i)
+			continue
+		}
+		if len(packet) > len(rebuilt) {
+			return nil, false
+		}
+		lengths ^= uint16(len(packet))
+		xorInto(rebuilt, packet)
+	}
+
+	// anything that doesn't come out as the packet we
+	// were after means the parity was no good
+	if int(lengths) < AudioPacketHeaderLen || int(lengths) > len(rebuilt) {
+		return nil, false
+	}
+	rebuilt = rebuilt[:lengths]
+	header, _, err := DecodeAudioPacket(rebuilt)
+	if err != nil || header.Sequence != sequence {
+		return nil, false
+	}
+
+	decoder.recovered.Add(1)
+	decoder.store(sequence, rebuilt)
+	return rebuilt, true
+}
+
+// store keeps a packet we've got, either from the network or rebuilt
+func (decoder *FECDecoder) store(sequence uint32, packet []byte) {
+	decoder.track(sequence)
+	decoder.packets[sequence] = packet
+	delete(decoder.missing, sequence)
+}
+
+// track notes that the sender has gotten as far as sequence. Anything
+// in between that we haven't seen is missing until it turns up, and
+// anything that's fallen out of the window is forgotten
+func (decoder *FECDecoder) track(sequence uint32) {
+	if !decoder.started {
+		decoder.started = true
+		decoder.highest = sequence
+		return
+	}
+
+	distance := SequenceDistance(decoder.highest, sequence)
+	if distance <= 0 {
+		return
+	}
+	// the sender restarted its stream, nothing we've got will help
+	if distance > FECWindowPackets {
+		clear(decoder.packets)
+		clear(decoder.parities)
+		clear(decoder.missing)
+		decoder.highest = sequence
+		return
+	}
+
+	for next := decoder.highest + 1; SequenceDistance(next, sequence) >= 0; next++ {
+		decoder.missing[next] = struct{}{}
+	}
+	decoder.highest = sequence
+
+	for old := range decoder.packets {
+		if SequenceDistance(old, decoder.highest) >= FECWindowPackets {
+			delete(decoder.packets, old)
+		}
+	}
+	for old := range decoder.missing {
+		if SequenceDistance(old, decoder.highest) >= FECWindowPackets {
+			delete(decoder.missing, old)
+			decoder.unrecoverable.Add(1)
+		}
+	}
+	for first := range decoder.parities {
+		if SequenceDistance(first, decoder.highest) >= FECWindowPackets {
+			delete(decoder.parities, first)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package shared
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fecGroup makes a group of audio packets starting at first. Their payloads
+// are different lengths, so recovering one has to get its length right too
+func fecGroup(first uint32, size int) [][]byte {
+	group := make([][]byte, size)
+	for i := range group {
+		header := AudioPacketHeader{
+			Format:    PayloadFormatPCM16,
+			SessionID: 7,
+			Sequence:  first + uint32(i),
+			Timestamp: uint64(i) * 240,
+		}
+		group[i] = EncodeAudioPacket(header, bytes.Repeat([]byte{byte(i + 1)}, 10+i*3))
+	}
+	return group
+}
+
+func TestFECRecovery(t *testing.T) {
+	tests := []struct {
+		name  string
+		first uint32
+		size  int
+		// lost are the indexes in the group that never show up
+		lost []int
+		// parityFirst sends the parity before the rest of the group
+		parityFirst bool
+		// recovered is the index we should get back, -1 for none
+		recovered int
+	}{
+		{name: "nothing lost", first: 10, size: 4, recovered: -1},
+		{name: "first lost", first: 10, size: 4, lost: []int{0}, recovered: 0},
+		{name: "middle lost", first: 10, size: 4, lost: []int{2}, recovered: 2},
+		{name: "last lost", first: 10, size: 4, lost: []int{3}, recovered: 3},
+		{name: "parity before the rest", first: 10, size: 4, lost: []int{1}, parityFirst: true, recovered: 1},
+		{name: "two lost", first: 10, size: 4, lost: []int{1, 2}, recovered: -1},
+		{name: "two lost, parity first", first: 10, size: 4, lost: []int{0, 3}, parityFirst: true, recovered: -1},
+		{name: "wraparound", first: ^uint32(0) - 1, size: 4, lost: []int{2}, recovered: 2},
+		{name: "wraparound, parity first", first: ^uint32(0), size: 3, lost: []int{0}, parityFirst: true, recovered: 0},
+		{name: "group of one", first: 5, size: 1, lost: []int{0}, recovered: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := fecGroup(test.first, test.size)
+			parity := EncodeParityPacket(group)
+			decoder := NewFECDecoder()
+
+			var recovered [][]byte
+			addParity := func() {
+				if rebuilt, ok := decoder.AddParity(parity); ok {
+					recovered = append(recovered, rebuilt)
+				}
+			}
+
+			if test.parityFirst {
+				addParity()
+			}
+			for i, packet := range group {
+				if !slices.Contains(test.lost, i) {
+					recovered = append(recovered, decoder.Add(test.first+uint32(i), packet)...)
+				}
+			}
+			if !test.parityFirst {
+				addParity()
+			}
+
+			if test.recovered < 0 {
+				if len(recovered) != 0 {
+					t.Fatalf("recovered %d packets, want none", len(recovered))
+				}
+				return
+			}
+			if len(recovered) != 1 {
+				t.Fatalf("recovered %d packets, want 1", len(recovered))
+			}
+			if !bytes.Equal(recovered[0], group[test.recovered]) {
+				t.Errorf("recovered packet doesn't match packet %d", test.recovered)
+			}
+			if stats := decoder.Stats(); stats.Recovered != 1 {
+				t.Errorf("stats say %d recovered, want 1", stats.Recovered)
+			}
+		})
+	}
+}
+
+func TestFECRejectsBadParity(t *testing.T) {
+	group := fecGroup(10, 3)
+
+	// parity for a group whose last packet claims to be some other packet
+	wrongSequence := fecGroup(10, 3)
+	header, payload, _ := DecodeAudioPacket(wrongSequence[2])
+	header.Sequence = 99
+	wrongSequence[2] = EncodeAudioPacket(header, payload)
+
+	// parity whose lengths say the lost packet is longer than the parity
+	wrongLength := EncodeParityPacket(group)
+	wrongLength[AudioPacketHeaderLen+1] ^= 0x40
+
+	emptyGroup := EncodeParityPacket(group)
+	emptyGroup[AudioPacketHeaderLen] = 0
+
+	hugeGroup := EncodeParityPacket(group)
+	hugeGroup[AudioPacketHeaderLen] = MaxFECGroupSize + 1
+
+	tests := []struct {
+		name   string
+		parity []byte
+	}{
+		{name: "rebuilt header doesn't match", parity: EncodeParityPacket(wrongSequence)},
+		{name: "wrong length", parity: wrongLength},
+		{name: "empty group", parity: emptyGroup},
+		{name: "group too big", parity: hugeGroup},
+		{name: "truncated", parity: EncodeParityPacket(group)[:AudioPacketHeaderLen+1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewFECDecoder()
+			decoder.Add(10, group[0])
+			decoder.Add(11, group[1])
+
+			if _, ok := decoder.AddParity(test.parity); ok {
+				t.Error("recovered a packet from bad parity")
+			}
+			if stats := decoder.Stats(); stats.Recovered != 0 {
+				t.Errorf("stats say %d recovered, want 0", stats.Recovered)
+			}
+		})
+	}
+}
+
+func TestFECUnrecoverable(t *testing.T) {
+	decoder := NewFECDecoder()
+	group := fecGroup(10, 4)
+	decoder.Add(10, group[0])
+	decoder.Add(13, group[3])
+	decoder.AddParity(EncodeParityPacket(group))
+
+	// the two lost packets only count as lost for good
+	// once they've fallen out of the window
+	if stats := decoder.Stats(); stats.Unrecoverable != 0 {
+		t.Fatalf("stats say %d unrecoverable before the window moved on, want 0", stats.Unrecoverable)
+	}
+	for sequence := uint32(14); sequence < 14+FECWindowPackets; sequence++ {
+		decoder.Add(sequence, fecGroup(sequence, 1)[0])
+	}
+	if stats := decoder.Stats(); stats.Unrecoverable != 2 {
+		t.Errorf("stats say %d unrecoverable, want 2", stats.Unrecoverable)
+	}
+}
+
+func TestFECSender(t *testing.T) {
+	format := AudioFormat{SampleRate: 48000, Channels: 1}
+	codec, err := NewCodec(PayloadFormatPCM16, format.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewFECSender(NewAudioSender(codec, nil, 7, format, 5*time.Millisecond), nil, 3)
+	packetFrames := 240
+
+	// groups carry over between calls, so a parity comes
+	// after every third packet however the audio's split up
+	var packets [][]byte
+	for _, frames := range []int{packetFrames * 2, packetFrames * 3, packetFrames} {
+		packets = append(packets, sender.Packetize(make([]float32, frames))...)
+	}
+
+	var kinds []bool
+	for _, packet := range packets {
+		kinds = append(kinds, IsParityPacket(packet))
+	}
+	want := []bool{false, false, false, true, false, false, false, true}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("parity packets came at %v, want %v", kinds, want)
+	}
+
+	// and the parity is enough to get a lost packet back
+	decoder := NewFECDecoder()
+	decoder.Add(0, packets[0])
+	decoder.Add(2, packets[2])
+	rebuilt, ok := decoder.AddParity(packets[3])
+	if !ok || !bytes.Equal(rebuilt, packets[1]) {
+		t.Error("couldn't recover a packet from the sender's parity")
+	}
+}
+
+func TestFECSealedParity(t *testing.T) {
+	format := AudioFormat{SampleRate: 48000, Channels: 1}
+	codec, err := NewCodec(PayloadFormatPCM16, format.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := NewPacketCipher(bytes.Repeat([]byte{1}, 32), AudioDirectionToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCipher, err := NewPacketCipher(bytes.Repeat([]byte{2}, 32), AudioDirectionToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewFECSender(NewAudioSender(codec, cipher, 7, format, 5*time.Millisecond), cipher, 3)
+	packets := sender.Packetize(sine(0, 240*3, 1))
+	parity := packets[3]
+
+	// parity for a group way off from where the stream is, which
+	// would make the decoder throw away everything it's holding
+	farOff := EncodeParityPacket(fecGroup(1<<20, 3))
+
+	tampered := slices.Clone(parity)
+	tampered[len(tampered)-1] ^= 1
+
+	moved := slices.Clone(parity)
+	moved[8] ^= 0x10
+
+	// an audio packet passed off as parity can't stand in for it either
+	relabeled := slices.Clone(packets[1])
+	relabeled[3] |= AudioPacketFlagParity
+
+	tests := []struct {
+		name   string
+		parity []byte
+	}{
+		{name: "not sealed", parity: farOff},
+		{name: "sealed with another key", parity: otherCipher.Seal(slices.Clone(farOff))},
+		{name: "payload tampered with", parity: tampered},
+		{name: "sequence moved", parity: moved},
+		{name: "audio relabeled as parity", parity: relabeled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewFECDecoder()
+			decoder.Add(0, packets[0])
+			decoder.Add(2, packets[2])
+
+			// like the server, parity only gets to the decoder once it's opened
+			opened, err := cipher.Open(test.parity)
+			if err == nil {
+				t.Error("forged parity opened")
+				decoder.AddParity(opened)
+			}
+			if stats := decoder.Stats(); stats != (FECStats{}) {
+				t.Errorf("stats are %+v after forged parity, want none", stats)
+			}
+
+			// and the real parity still gets the lost packet back
+			opened, err = cipher.Open(parity)
+			if err != nil {
+				t.Fatalf("couldn't open the sender's parity: %s", err)
+			}
+			rebuilt, ok := decoder.AddParity(opened)
+			if !ok || !bytes.Equal(rebuilt, packets[1]) {
+				t.Error("couldn't recover a packet after forged parity")
+			}
+		})
+	}
+}
+
+func TestSealedParityNonce(t *testing.T) {
+	cipher, err := NewPacketCipher(bytes.Repeat([]byte{1}, 32), AudioDirectionToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parity has the same sequence and timestamp as the first packet in
+	// its group, so the same payload has to come out sealed differently
+	header := AudioPacketHeader{Format: PayloadFormatPCM16, SessionID: 7, Sequence: 10, Timestamp: 240}
+	payload := bytes.Repeat([]byte{3}, 16)
+	audio := cipher.Seal(EncodeAudioPacket(header, payload))
+	header.Flags = AudioPacketFlagParity
+	parity := cipher.Seal(EncodeAudioPacket(header, payload))
+
+	// the tags differ anyway since the headers do, so only the ciphertext counts
+	ciphertext := func(sealed []byte) []byte {
+		return sealed[AudioPacketHeaderLen : len(sealed)-AudioPacketSealOverhead]
+	}
+	if bytes.Equal(ciphertext(audio), ciphertext(parity)) {
+		t.Error("audio and parity packets were sealed with the same nonce")
+	}
+}
@@ -0,0 +1,73 @@
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// AudioFormat is the sample rate and channel count of some audio
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// MixFormat is the format the server mixes in. Clients that don't
+// say what format they're in are in this one
+var MixFormat = AudioFormat{SampleRate: AudioSampleRate, Channels: NumOutputChannels}
+
+func (format AudioFormat) String() string {
+	return fmt.Sprintf("%dHz/%dch", format.SampleRate, format.Channels)
+}
+
+// Valid tells you if we can handle audio in the format
+func (format AudioFormat) Valid() bool {
+	return format.SampleRate >= MinSampleRate && format.SampleRate <= MaxSampleRate &&
+		format.Channels >= 1 && format.Channels <= MaxChannels
+}
+
+// FramesDuration is how long frames of audio at sampleRate play for
+func FramesDuration(frames, sampleRate int) time.Duration {
+	return time.Duration(frames) * time.Second / time.Duration(sampleRate)
+}
+
+// DurationFrames is how many frames of audio at sampleRate play for duration
+func DurationFrames(duration time.Duration, sampleRate int) int {
+	return int(duration * time.Duration(sampleRate) / time.Second)
+}
+
+// RemixChannels changes the channel count of interleaved audio. Going down,
+// channels are folded onto the ones that are left and averaged, so stereo
+// becomes mono. Going up, the channels we have are repeated, so mono
+// becomes the same audio on both sides
+func RemixChannels(samples []float32, from, to int) []float32 {
+	if from == to {
+		return samples
+	}
+
+	frames := len(samples) / from
+	out := make([]float32, frames*to)
+	if to > from {
+		for frame := range frames {
+			for ch := range to {
+				out[frame*to+ch] = samples[frame*from+ch%from]
+			}
+		}
+		return out
+	}
+
+	for frame := range frames {
+		for ch := range from {
+			out[frame*to+ch%to] += samples[frame*from+ch]
+		}
+		for ch := range to {
+			// the first from%to channels get one more
+			// channel folded onto them than the rest
+			folded := from / to
+			if ch < from%to {
+				folded++
+			}
+			out[frame*to+ch] /= float32(folded)
+		}
+	}
+	return out
+}
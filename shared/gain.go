@@ -0,0 +1,40 @@
+package shared
+
+import "math"
+
+// DBToGain turns a gain in decibels into what to multiply samples by
+func DBToGain(db float64) float32 {
+	return float32(math.Pow(10, db/20))
+}
+
+// GainRamp turns audio up or down, easing into every change of gain over
+// GainSmoothingTime so it doesn't zipper. It isn't thread safe, it's meant
+// to be used by a single audio callback
+type GainRamp struct {
+	gain    float32
+	started bool
+}
+
+// Apply multiplies interleaved samples by a gain ramping towards target. The
+// first time it's applied, it starts right at target
+func (ramp *GainRamp) Apply(samples []float32, format AudioFormat, target float32) {
+	if !ramp.started {
+		ramp.gain = target
+		ramp.started = true
+	}
+
+	// one pole smoothing, a frame at a time so
+	// every channel gets the same gain
+	coefficient := float32(1 - math.Exp(-1/(GainSmoothingTime.Seconds()*float64(format.SampleRate))))
+	for frame := 0; frame+format.Channels <= len(samples); frame += format.Channels {
+		if ramp.gain != target {
+			ramp.gain += (target - ramp.gain) * coefficient
+			if math.Abs(float64(target-ramp.gain)) < GainSettledThreshold {
+				ramp.gain = target
+			}
+		}
+		for i := frame; i < frame+format.Channels; i++ {
+			samples[i] *= ramp.gain
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package shared
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// JitterStatus is the result of pulling the next packet out of a jitter buffer
+type JitterStatus int
+
+const (
+	// JitterStatusOK means the next packet was ready to play
+	JitterStatusOK JitterStatus = iota
+	// JitterStatusLost means the next packet never showed up in time
+	// and the playout point has skipped past it
+	JitterStatusLost
+	// JitterStatusBuffering means the buffer is still filling up to its
+	// target depth, either because it just started or because it ran dry
+	JitterStatusBuffering
+)
+
+// JitterPacket is a packet of decoded audio sitting in a jitter buffer
+type JitterPacket struct {
+	// Sequence is the sequence number of the packet. For lost packets
+	// this is the first sequence number that went missing
+	Sequence uint32
+	// Timestamp is the position of the first frame in the stream
+	Timestamp uint64
+	// Frames is the amount of frames the packet covers. For lost
+	// packets this is the amount of frames that went missing
+	Frames int
+	// Samples is the interleaved audio. It's nil for lost packets
+	Samples []float32
+	// Presentation is when the packet is meant to be played, in unix
+	// nanoseconds of the sender's clock. It's 0 if the sender didn't say
+	Presentation int64
+}
+
+// JitterStats are the running counters of a jitter buffer
+type JitterStats struct {
+	// Received is the amount of packets accepted into the buffer
+	Received uint64 `json:"received"`
+	// Duplicates is the amount of packets dropped because we already had them
+	Duplicates uint64 `json:"duplicates"`
+	// Late is the amount of packets dropped because they arrived after
+	// their playout point
+	Late uint64 `json:"late"`
+	// Lost is the amount of packets that never arrived in time
+	Lost uint64 `json:"lost"`
+	// Underruns is the amount of times the buffer ran dry while playing
+	Underruns uint64 `json:"underruns"`
+	// Overflows is the amount of packets dropped because the buffer
+	// grew past its maximum depth
+	Overflows uint64 `json:"overflows"`
+	// JitterFrames is the estimated interarrival jitter, in frames
+	JitterFrames float64 `json:"jitterFrames"`
+	// DepthFrames is the amount of frames currently buffered
+	DepthFrames int `json:"depthFrames"`
+	// TargetDepthFrames is the amount of frames the buffer is aiming to hold
+	TargetDepthFrames int `json:"targetDepthFrames"`
+}
+
+// JitterBuffer puts packets that arrive out of order, late, or more than
+// once back into a clean, ordered stream
+type JitterBuffer interface {
+	// Push adds a packet to the buffer. It returns false if the packet
+	// was dropped as a duplicate or for arriving too late
+	Push(header AudioPacketHeader, samples []float32, arrival time.Time) bool
+	// Pop takes the next packet out of the buffer
+	Pop() (JitterPacket, JitterStatus)
+	// Stats returns the buffer's counters
+	Stats() JitterStats
+}
+
+type jitterBuffer struct {
+	channels   int
+	sampleRate int
+	minDepth   int
+	maxDepth   int
+
+	packets map[uint32]JitterPacket
+	// depth is the amount of frames sitting in packets
+	depth int
+
+	// started is set once the first packet arrives and nextSequence
+	// means something
+	started       bool
+	playing       bool
+	nextSequence  uint32
+	nextTimestamp uint64
+
+	// arrivalBase is the arrival time of the first packet. Transit times
+	// are measured relative to it to keep the floats small
+	arrivalBase time.Time
+	hasTransit  bool
+	lastTransit float64
+	jitter      float64
+
+	stats JitterStats
+	mu    sync.Mutex
+}
+
+// NewJitterBuffer creates a new jitter buffer. The depths are in frames; the buffer
+// waits for at least minDepth frames before playing and grows its target with the
+// measured jitter, up to maxDepth
+func NewJitterBuffer(channels, sampleRate, minDepth, maxDepth int) JitterBuffer {
+	return &jitterBuffer{
+		channels:   channels,
+		sampleRate: sampleRate,
+		minDepth:   minDepth,
+		maxDepth:   max(minDepth, maxDepth),
+		packets:    make(map[uint32]JitterPacket),
+		mu:         sync.Mutex{},
+	}
+}
+
+func (jb *jitterBuffer) Push(header AudioPacketHeader, samples []float32, arrival time.Time) bool {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	if !jb.started {
+		jb.started = true
+		jb.nextSequence = header.Sequence
+		jb.nextTimestamp = header.Timestamp
+		jb.arrivalBase = arrival
+	}
+
+	distance := SequenceDistance(jb.nextSequence, header.Sequence)
+	if distance < 0 {
+		if jb.playing {
+			jb.stats.Late++
+			return false
+		}
+		// We haven't played anything yet, so an earlier packet just
+		// moves the start of the stream back
+		jb.nextSequence = header.Sequence
+		jb.nextTimestamp = header.Timestamp
+	}
+	if distance >= JitterBufferMaxPackets {
+		// The sender jumped way ahead of us, most likely because it
+		// restarted its stream. Nothing we're holding is worth keeping
+		jb.resetUnsafe(header)
+	}
+
+	if _, exists := jb.packets[header.Sequence]; exists {
+		jb.stats.Duplicates++
+		return false
+	}
+
+	packet := JitterPacket{
+		Sequence:  header.Sequence,
+		Timestamp: header.Timestamp,
+		Frames:    len(samples) / jb.channels,
+		Samples:   samples,
+	}
+	if header.Flags&AudioPacketFlagPresentation != 0 {
+		packet.Presentation = header.Presentation
+	}
+	jb.packets[header.Sequence] = packet
+	jb.depth += packet.Frames
+	jb.stats.Received++
+	jb.updateJitterUnsafe(header.Timestamp, arrival)
+
+	return true
+}
+
+func (jb *jitterBuffer) Pop() (JitterPacket, JitterStatus) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	if !jb.playing {
+		if len(jb.packets) == 0 || jb.depth < jb.targetDepthUnsafe() {
+			return JitterPacket{}, JitterStatusBuffering
+		}
+
+		// Start playing from the oldest packet we have, whatever
+		// happened before it isn't coming
+		earliest := jb.earliestUnsafe()
+		jb.nextSequence = earliest.Sequence
+		jb.nextTimestamp = earliest.Timestamp
+		jb.playing = true
+	}
+
+	// If we've fallen too far behind, throw away the oldest audio to
+	// bring the latency back down to the target
+	for jb.depth > jb.maxDepth {
+		packet, ok := jb.packets[jb.nextSequence]
+		if ok {
+			jb.removeUnsafe(packet)
+			jb.stats.Overflows++
+		}
+		jb.nextSequence++
+		if !ok {
+			continue
+		}
+		jb.nextTimestamp = packet.Timestamp + uint64(packet.Frames)
+	}
+
+	packet, ok := jb.packets[jb.nextSequence]
+	if ok {
+		jb.removeUnsafe(packet)
+		jb.nextSequence++
+		jb.nextTimestamp = packet.Timestamp + uint64(packet.Frames)
+		return packet, JitterStatusOK
+	}
+
+	if len(jb.packets) == 0 {
+		jb.playing = false
+		jb.stats.Underruns++
+		return JitterPacket{}, JitterStatusBuffering
+	}
+
+	// The next packet is missing but later ones are here, so it's lost.
+	// Skip ahead to the next packet we do have
+	earliest := jb.earliestUnsafe()
+	lost := JitterPacket{
+		Sequence:  jb.nextSequence,
+		Timestamp: jb.nextTimestamp,
+	}
+	if earliest.Timestamp > jb.nextTimestamp {
+		lost.Frames = int(earliest.Timestamp - jb.nextTimestamp)
+	}
+	jb.stats.Lost += uint64(SequenceDistance(jb.nextSequence, earliest.Sequence))
+	jb.nextSequence = earliest.Sequence
+	jb.nextTimestamp = earliest.Timestamp
+
+	return lost, JitterStatusLost
+}
+
+func (jb *jitterBuffer) Stats() JitterStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	stats := jb.stats
+	stats.JitterFrames = jb.jitter
+	stats.DepthFrames = jb.depth
+	stats.TargetDepthFrames = jb.targetDepthUnsafe()
+	return stats
+}
+
+// targetDepthUnsafe is how much audio we want buffered before playing. We leave
+// room for a few times the measured jitter on top of the minimum
+func (jb *jitterBuffer) targetDepthUnsafe() int {
+	target := jb.minDepth + int(math.Ceil(JitterBufferJitterMultiplier*jb.jitter))
+	return min(target, jb.maxDepth)
+}
+
+// updateJitterUnsafe updates the interarrival jitter estimate the same way
+// RTP does (RFC 3550 section 6.4.1), measured in frames
+func (jb *jitterBuffer) updateJitterUnsafe(timestamp uint64, arrival time.Time) {
+	arrivalFrames := arrival.Sub(jb.arrivalBase).Seconds() * float64(jb.sampleRate)
+	transit := arrivalFrames - float64(timestamp)
+	if jb.hasTransit {
+		difference := math.Abs(transit - jb.lastTransit)
+		jb.jitter += (difference - jb.jitter) / 16
+	}
+	jb.lastTransit = transit
+	jb.hasTransit = true
+}
+
+// earliestUnsafe finds the buffered packet closest to the playout point. There
+// must be at least one packet in the buffer
+func (jb *jitterBuffer) earliestUnsafe() JitterPacket {
+	var earliest JitterPacket
+	closest := math.MaxInt
+	for sequence, packet := range jb.packets {
+		distance := SequenceDistance(jb.nextSequence, sequence)
+		if distance < closest {
+			closest = distance
+			earliest = packet
+		}
+	}
+	return earliest
+}
+
+func (jb *jitterBuffer) removeUnsafe(packet JitterPacket) {
+	delete(jb.packets, packet.Sequence)
+	jb.depth -= packet.Frames
+}
+
+func (jb *jitterBuffer) resetUnsafe(header AudioPacketHeader) {
+	clear(jb.packets)
+	jb.depth = 0
+	jb.playing = false
+	jb.nextSequence = header.Sequence
+	jb.nextTimestamp = header.Timestamp
+	jb.hasTransit = false
+}
+
+// SequenceDistance is how many packets ahead of from the sequence number to
+// is. It's negative if to is behind from, and handles wrapping around
+func SequenceDistance(from, to uint32) int {
+	return int(int32(to - from))
+}
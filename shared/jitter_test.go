@@ -0,0 +1,220 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+// jitterPacketFrames is how many frames the test packets hold, 5ms at 48kHz
+const jitterPacketFrames = 240
+
+// jitterStep is one thing done to a jitter buffer, either pushing a packet or popping one
+type jitterStep struct {
+	pop bool
+	// index is the packet pushed, or the one the pop should give back, as
+	// how far it is from the first sequence
+	index int
+	// accepted is whether the push should be accepted
+	accepted bool
+	// status is what the pop should give back
+	status JitterStatus
+	// lost is how many packets a lost pop skips over
+	lost int
+}
+
+func push(index int, accepted bool) jitterStep {
+	return jitterStep{index: index, accepted: accepted}
+}
+
+func pop(status JitterStatus, index int) jitterStep {
+	return jitterStep{pop: true, index: index, status: status}
+}
+
+func popLost(index, lost int) jitterStep {
+	return jitterStep{pop: true, index: index, status: JitterStatusLost, lost: lost}
+}
+
+// jitterHeader is the header of the packet index packets after first. Packets
+// are evenly spaced, so arriving on time means arriving at index*5ms
+func jitterHeader(first uint32, index int) AudioPacketHeader {
+	return AudioPacketHeader{
+		Sequence:  first + uint32(index),
+		Timestamp: uint64(index) * jitterPacketFrames,
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	tests := []struct {
+		name  string
+		first uint32
+		steps []jitterStep
+		stats JitterStats
+	}{
+		{
+			name:  "in order",
+			first: 100,
+			steps: []jitterStep{
+				push(0, true), push(1, true), push(2, true),
+				pop(JitterStatusOK, 0), pop(JitterStatusOK, 1), pop(JitterStatusOK, 2),
+			},
+			stats: JitterStats{Received: 3},
+		},
+		{
+			name:  "out of order",
+			first: 100,
+			steps: []jitterStep{
+				push(2, true), push(0, true), push(3, true), push(1, true),
+				pop(JitterStatusOK, 0), pop(JitterStatusOK, 1), pop(JitterStatusOK, 2), pop(JitterStatusOK, 3),
+			},
+			stats: JitterStats{Received: 4},
+		},
+		{
+			name:  "duplicates",
+			first: 100,
+			steps: []jitterStep{
+				push(0, true), push(1, true), push(1, false), push(0, false), push(2, true),
+				pop(JitterStatusOK, 0), pop(JitterStatusOK, 1), pop(JitterStatusOK, 2),
+			},
+			stats: JitterStats{Received: 3, Duplicates: 2},
+		},
+		{
+			name:  "older than the playout point",
+			first: 100,
+			steps: []jitterStep{
+				push(0, true), push(1, true), push(2, true),
+				pop(JitterStatusOK, 0), pop(JitterStatusOK, 1),
+				push(0, false), push(1, false),
+				pop(JitterStatusOK, 2),
+			},
+			stats: JitterStats{Received: 3, Late: 2},
+		},
+		{
+			name:  "lost packet is skipped",
+			first: 100,
+			steps: []jitterStep{
+				push(0, true), push(2, true), push(3, true),
+				pop(JitterStatusOK, 0), popLost(1, 1), pop(JitterStatusOK, 2), pop(JitterStatusOK, 3),
+				push(1, false),
+			},
+			stats: JitterStats{Received: 3, Lost: 1, Late: 1},
+		},
+		{
+			name:  "running dry",
+			first: 100,
+			steps: []jitterStep{
+				push(0, true),
+				pop(JitterStatusOK, 0), pop(JitterStatusBuffering, 0),
+				push(1, true),
+				pop(JitterStatusOK, 1),
+			},
+			stats: JitterStats{Received: 2, Underruns: 1},
+		},
+		{
+			name:  "wraparound",
+			first: ^uint32(0) - 1,
+			steps: []jitterStep{
+				push(1, true), push(3, true), push(0, true), push(2, true), push(2, false),
+				pop(JitterStatusOK, 0), pop(JitterStatusOK, 1), pop(JitterStatusOK, 2), pop(JitterStatusOK, 3),
+			},
+			stats: JitterStats{Received: 4, Duplicates: 1},
+		},
+		{
+			name:  "lost across wraparound",
+			first: ^uint32(0),
+			steps: []jitterStep{
+				push(0, true), push(3, true),
+				pop(JitterStatusOK, 0), popLost(1, 2), pop(JitterStatusOK, 3),
+				push(0, false), push(2, false),
+			},
+			stats: JitterStats{Received: 2, Lost: 2, Late: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// a single packet is enough to start playing
+			buffer := NewJitterBuffer(1, AudioSampleRate, jitterPacketFrames, JitterBufferMaxDepthFrames)
+			start := time.Now()
+
+			for i, step := range test.steps {
+				header := jitterHeader(test.first, step.index)
+				if !step.pop {
+					arrival := start.Add(FramesDuration(int(header.Timestamp), AudioSampleRate))
+					accepted := buffer.Push(header, make([]float32, jitterPacketFrames), arrival)
+					if accepted != step.accepted {
+						t.Fatalf("step %d: pushing packet %d was accepted %v, want %v", i, step.index, accepted, step.accepted)
+					}
+					continue
+				}
+
+				packet, status := buffer.Pop()
+				if status != step.status {
+					t.Fatalf("step %d: popped status %d, want %d", i, status, step.status)
+				}
+				if status != JitterStatusBuffering && packet.Sequence != header.Sequence {
+					t.Fatalf("step %d: popped sequence %d, want %d", i, packet.Sequence, header.Sequence)
+				}
+				if status == JitterStatusLost && packet.Frames != step.lost*jitterPacketFrames {
+					t.Errorf("step %d: lost %d frames, want %d", i, packet.Frames, step.lost*jitterPacketFrames)
+				}
+			}
+
+			stats := buffer.Stats()
+			stats.JitterFrames = 0
+			stats.DepthFrames = 0
+			stats.TargetDepthFrames = 0
+			if stats != test.stats {
+				t.Errorf("stats are %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
+
+func TestJitterBufferTargetDepth(t *testing.T) {
+	tests := []struct {
+		name string
+		// late is how late every other packet arrives
+		late time.Duration
+		// minTarget and maxTarget are where the target depth has to end up
+		minTarget int
+		maxTarget int
+	}{
+		// arrival times in float seconds round a little, which can be a frame of jitter
+		{name: "no jitter", late: 0, minTarget: JitterBufferMinDepthFrames, maxTarget: JitterBufferMinDepthFrames + 1},
+		{name: "some jitter", late: 5 * time.Millisecond, minTarget: JitterBufferMinDepthFrames + 2, maxTarget: JitterBufferMaxDepthFrames - 1},
+		{name: "more jitter", late: 20 * time.Millisecond, minTarget: JitterBufferMinDepthFrames + 2, maxTarget: JitterBufferMaxDepthFrames - 1},
+		{name: "too much jitter", late: time.Second, minTarget: JitterBufferMaxDepthFrames, maxTarget: JitterBufferMaxDepthFrames},
+	}
+
+	previous := 0
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := NewJitterBuffer(1, AudioSampleRate, JitterBufferMinDepthFrames, JitterBufferMaxDepthFrames)
+			start := time.Now()
+
+			for index := range 200 {
+				header := jitterHeader(0, index)
+				arrival := start.Add(FramesDuration(int(header.Timestamp), AudioSampleRate))
+				if index%2 == 1 {
+					arrival = arrival.Add(test.late)
+				}
+				buffer.Push(header, make([]float32, jitterPacketFrames), arrival)
+
+				target := buffer.Stats().TargetDepthFrames
+				if target < JitterBufferMinDepthFrames || target > JitterBufferMaxDepthFrames {
+					t.Fatalf("target depth went to %d frames", target)
+				}
+			}
+
+			target := buffer.Stats().TargetDepthFrames
+			if target < test.minTarget || target > test.maxTarget {
+				t.Errorf("target depth is %d frames, want between %d and %d", target, test.minTarget, test.maxTarget)
+			}
+			// the cases go up in jitter, so the target should too
+			if target < previous {
+				t.Errorf("target depth is %d frames, less than the %d with less jitter", target, previous)
+			}
+			previous = target
+		})
+	}
+}
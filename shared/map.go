@@ -35,10 +35,7 @@ type threadSafeMap[T comparable, K any] struct {
 // NewThreadSafeMap creates a new thread safe map. If the provided data cap is <= 0,
 // the map will not cap the data
 func NewThreadSafeMap[T comparable, K any](dataCap int) ThreadSafeMap[T, K] {
-	var data map[T]K
-	if dataCap > 0 {
-		data = make(map[T]K, dataCap)
-	}
+	data := make(map[T]K, max(dataCap, 0))
 
 	return &threadSafeMap[T, K]{
 		data:    data,
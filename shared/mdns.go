@@ -0,0 +1,208 @@
+package shared
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MDNSService is a media server advertised as a DNS-SD service
+type MDNSService struct {
+	// Name is the server's name. It's also the service's instance name
+	Name string
+	// Host is the server's mDNS host name, like "studio.local."
+	Host string
+	// DiscoveryPort is where the server takes discovery and identification
+	DiscoveryPort int
+	// AudioPort is where the server takes audio
+	AudioPort int
+	// ProtocolVersions are the protocol versions the server speaks
+	ProtocolVersions ProtocolVersionRange
+}
+
+// NewMDNSService describes this machine's media server as a DNS-SD service
+func NewMDNSService(name string, discoveryPort, audioPort int) MDNSService {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "mediacenter"
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	return MDNSService{
+		Name:             name,
+		Host:             hostname + "." + MDNSDomain,
+		DiscoveryPort:    discoveryPort,
+		AudioPort:        audioPort,
+		ProtocolVersions: SupportedProtocolVersions,
+	}
+}
+
+// MDNSServiceName is the name of the DNS-SD service type we browse for
+func MDNSServiceName() string {
+	return MDNSServiceType + "." + MDNSDomain
+}
+
+// Instance is the service's full instance name, like "studio._jam._udp.local."
+func (service MDNSService) Instance() string {
+	// dots would split the name into more labels, and a
+	// label can't be longer than 63 bytes
+	label := strings.ReplaceAll(service.Name, ".", "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label + "." + MDNSServiceName()
+}
+
+// PTR is the record pointing the service type at this service
+func (service MDNSService) PTR(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: mdnsHeader(MDNSServiceName(), dnsmessage.TypePTR, ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(service.Instance())},
+	}
+}
+
+// SRV is the record pointing the service at the host and port to contact it on
+func (service MDNSService) SRV(ttl uint32, cacheFlush bool) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: mdnsHeader(service.Instance(), dnsmessage.TypeSRV, ttl, cacheFlush),
+		Body: &dnsmessage.SRVResource{
+			Target: dnsmessage.MustNewName(service.Host),
+			Port:   uint16(service.DiscoveryPort),
+		},
+	}
+}
+
+// TXT is the record with the rest of what we know about the service
+func (service MDNSService) TXT(ttl uint32, cacheFlush bool) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: mdnsHeader(service.Instance(), dnsmessage.TypeTXT, ttl, cacheFlush),
+		Body: &dnsmessage.TXTResource{TXT: []string{
+			MDNSTXTVersionKey + "=" + service.ProtocolVersions.String(),
+			MDNSTXTNameKey + "=" + service.Name,
+			MDNSTXTAudioPortKey + "=" + strconv.Itoa(service.AudioPort),
+		}},
+	}
+}
+
+// AddressRecords are the A and AAAA records for the service's host
+func (service MDNSService) AddressRecords(ttl uint32, cacheFlush bool, ips []net.IP) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsmessage.Resource{
+				Header: mdnsHeader(service.Host, dnsmessage.TypeA, ttl, cacheFlush),
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+			continue
+		}
+		records = append(records, dnsmessage.Resource{
+			Header: mdnsHeader(service.Host, dnsmessage.TypeAAAA, ttl, cacheFlush),
+			Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())},
+		})
+	}
+
+	return records
+}
+
+// CraftMDNSQuery puts together a one-shot query for media servers. It's sent
+// from an ordinary port, so responders answer it straight back to us
+func CraftMDNSQuery() ([]byte, error) {
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(MDNSServiceName()),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return query.Pack()
+}
+
+// ReadMDNSServices reads the media servers out of an mDNS response
+func ReadMDNSServices(message []byte) ([]MDNSService, error) {
+	var response dnsmessage.Message
+	err := response.Unpack(message)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Response {
+		return nil, nil
+	}
+
+	var instances []string
+	srvs := make(map[string]*dnsmessage.SRVResource)
+	txts := make(map[string]*dnsmessage.TXTResource)
+	for _, record := range append(response.Answers, response.Additionals...) {
+		name := strings.ToLower(record.Header.Name.String())
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == strings.ToLower(MDNSServiceName()) {
+				instances = append(instances, strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			srvs[name] = body
+		case *dnsmessage.TXTResource:
+			txts[name] = body
+		}
+	}
+
+	var services []MDNSService
+	for _, instance := range instances {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+
+		service := MDNSService{
+			Name:             strings.TrimSuffix(instance, "."+MDNSServiceName()),
+			Host:             srv.Target.String(),
+			DiscoveryPort:    int(srv.Port),
+			ProtocolVersions: LegacyProtocolVersions,
+		}
+		if txt, ok := txts[instance]; ok {
+			items := readTXT(txt.TXT)
+			if name, ok := items[MDNSTXTNameKey]; ok {
+				service.Name = name
+			}
+			service.AudioPort, _ = strconv.Atoi(items[MDNSTXTAudioPortKey])
+			service.ProtocolVersions, err = readProtocolVersions(map[string]string{
+				ProtocolVersionsKey: items[MDNSTXTVersionKey],
+			})
+			if err != nil {
+				continue
+			}
+		}
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+// mdnsHeader puts together a resource header. Records only we can answer for
+// set the cache flush bit, so stale copies get thrown out
+func mdnsHeader(name string, recordType dnsmessage.Type, ttl uint32, cacheFlush bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if cacheFlush {
+		class |= MDNSCacheFlushBit
+	}
+
+	return dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  recordType,
+		Class: class,
+		TTL:   ttl,
+	}
+}
+
+// readTXT reads key=value TXT strings
+func readTXT(txt []string) map[string]string {
+	items := make(map[string]string, len(txt))
+	for _, item := range txt {
+		key, value, _ := strings.Cut(item, "=")
+		items[strings.ToLower(key)] = value
+	}
+
+	return items
+}
@@ -0,0 +1,58 @@
+package shared
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv6"
+)
+
+// MulticastInterfaces returns the interfaces that are up and can do multicast
+func MulticastInterfaces() []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	return FilterSlice(interfaces, func(ifi net.Interface) bool {
+		return ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0
+	})
+}
+
+// JoinIPv6Group joins the IPv6 multicast group on every interface that can, so
+// conn gets messages sent to the group. It only fails if no interface could join
+func JoinIPv6Group(conn net.PacketConn, group net.IP) error {
+	packetConn := ipv6.NewPacketConn(conn)
+
+	var errs []error
+	joined := 0
+	for _, ifi := range MulticastInterfaces() {
+		err := packetConn.JoinGroup(&ifi, &net.UDPAddr{IP: group})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		return errors.Join(append(errs, errors.New("no interface could join the multicast group"))...)
+	}
+
+	return nil
+}
+
+// DiscoveryAddrs are the addresses we send discovery requests to. That's the
+// IPv4 broadcast address, and the IPv6 discovery group on every interface,
+// since link-local multicast has to go out of a specific interface
+func DiscoveryAddrs(port int) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{{IP: net.IPv4bcast, Port: port}}
+	for _, ifi := range MulticastInterfaces() {
+		addrs = append(addrs, &net.UDPAddr{
+			IP:   net.ParseIP(DiscoveryMulticastGroup),
+			Port: port,
+			Zone: ifi.Name,
+		})
+	}
+
+	return addrs
+}
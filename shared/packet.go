@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotAudioPacket is returned when a message doesn't start with
+	// the audio packet magic byte
+	ErrNotAudioPacket = errors.New("not an audio packet")
+	// ErrAudioPacketTooShort is returned when a message is too short
+	// to hold an audio packet header
+	ErrAudioPacketTooShort = errors.New("audio packet too short")
+	// ErrUnsupportedAudioPacketVersion is returned when the audio packet
+	// header version is one we don't know how to read
+	ErrUnsupportedAudioPacketVersion = errors.New("unsupported audio packet version")
+)
+
+// AudioPacketHeader is the binary header at the front of every audio packet.
+//
+// The layout on the wire (big endian) is:
+//
+//	magic (1) | version (1) | format (1) | flags (1) |
+//	session ID (4) | sequence (4) | timestamp (8)
+//
+// Packets with the presentation flag set carry their presentation time at the
+// front of the payload, so it's sealed along with the audio
+type AudioPacketHeader struct {
+	// Version is the header version
+	Version uint8
+	// Format is the format of the payload following the header
+	Format PayloadFormat
+	// Flags is reserved for per-packet flags
+	Flags uint8
+	// SessionID is the compact session ID the server handed out
+	// during identification
+	SessionID uint32
+	// Sequence increments by one for every packet in a stream
+	Sequence uint32
+	// Timestamp is the position, in sample frames, of the first
+	// frame of the payload within the stream
+	Timestamp uint64
+	// Presentation is when the first frame of the payload is meant to be
+	// played, in unix nanoseconds of the sender's clock. It's only
+	// there when the presentation flag is set
+	Presentation int64
+}
+
+// IsAudioPacket tells you if the message looks like an audio packet
+func IsAudioPacket(message []byte) bool {
+	return len(message) > 0 && message[0] == AudioPacketMagic
+}
+
+// EncodeAudioPacket writes the header followed by the payload into a new packet
+func EncodeAudioPacket(header AudioPacketHeader, payload []byte) []byte {
+	headerLen := AudioPacketHeaderLen
+	if header.Flags&AudioPacketFlagPresentation != 0 {
+		headerLen += AudioPacketPresentationLen
+	}
+
+	packet := make([]byte, headerLen+len(payload))
+	EncodeAudioPacketHeader(packet, header)
+	if header.Flags&AudioPacketFlagPresentation != 0 {
+		binary.BigEndian.PutUint64(packet[AudioPacketHeaderLen:], uint64(header.Presentation))
+	}
+	copy(packet[headerLen:], payload)
+	return packet
+}
+
+// EncodeAudioPacketHeader writes the header into the start of dst. dst must be
+// at least AudioPacketHeaderLen long
+func EncodeAudioPacketHeader(dst []byte, header AudioPacketHeader) {
+	version := header.Version
+	if version == 0 {
+		version = AudioPacketVersion
+	}
+
+	dst[0] = AudioPacketMagic
+	dst[1] = version
+	dst[2] = byte(header.Format)
+	dst[3] = header.Flags
+	binary.BigEndian.PutUint32(dst[4:8], header.SessionID)
+	binary.BigEndian.PutUint32(dst[8:12], header.Sequence)
+	binary.BigEndian.PutUint64(dst[12:20], header.Timestamp)
+}
+
+// DecodeAudioPacket reads the header out of an audio packet and returns it
+// along with the payload. The payload shares memory with the packet
+func DecodeAudioPacket(packet []byte) (AudioPacketHeader, []byte, error) {
+	if !IsAudioPacket(packet) {
+		return AudioPacketHeader{}, nil, ErrNotAudioPacket
+	}
+	if len(packet) < AudioPacketHeaderLen {
+		return AudioPacketHeader{}, nil, ErrAudioPacketTooShort
+	}
+
+	header := AudioPacketHeader{
+		Version:   packet[1],
+		Format:    PayloadFormat(packet[2]),
+		Flags:     packet[3],
+		SessionID: binary.BigEndian.Uint32(packet[4:8]),
+		Sequence:  binary.BigEndian.Uint32(packet[8:12]),
+		Timestamp: binary.BigEndian.Uint64(packet[12:20]),
+	}
+	if header.Version != AudioPacketVersion {
+		return header, nil, ErrUnsupportedAudioPacketVersion
+	}
+
+	payload := packet[AudioPacketHeaderLen:]
+	if header.Flags&AudioPacketFlagPresentation != 0 {
+		if len(payload) < AudioPacketPresentationLen {
+			return header, nil, ErrAudioPacketTooShort
+		}
+		header.Presentation = int64(binary.BigEndian.Uint64(payload))
+		payload = payload[AudioPacketPresentationLen:]
+	}
+
+	return header, payload, nil
+}
+
+// PresentationTime is when the first frame of the payload is meant to be
+// played. It's false if the packet doesn't say
+func (header AudioPacketHeader) PresentationTime() (time.Time, bool) {
+	if header.Flags&AudioPacketFlagPresentation == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, header.Presentation), true
+}
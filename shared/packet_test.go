@@ -0,0 +1,149 @@
+package shared
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAudioPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  AudioPacketHeader
+		payload []byte
+	}{
+		{
+			name: "plain",
+			header: AudioPacketHeader{
+				Format:    PayloadFormatPCM16,
+				SessionID: 7,
+				Sequence:  42,
+				Timestamp: 48000,
+			},
+			payload: []byte{1, 2, 3, 4},
+		},
+		{
+			name: "empty payload",
+			header: AudioPacketHeader{
+				Format:    PayloadFormatFloat32,
+				SessionID: 1,
+			},
+		},
+		{
+			name: "largest values",
+			header: AudioPacketHeader{
+				Format:    PayloadFormatIMAADPCM,
+				Flags:     AudioPacketFlagSealed,
+				SessionID: ^uint32(0),
+				Sequence:  ^uint32(0),
+				Timestamp: ^uint64(0),
+			},
+			payload: bytes.Repeat([]byte{0xFF}, NetworkPacketSizeBytes),
+		},
+		{
+			name: "presentation",
+			header: AudioPacketHeader{
+				Format:       PayloadFormatPCM16,
+				Flags:        AudioPacketFlagPresentation,
+				SessionID:    3,
+				Sequence:     9,
+				Timestamp:    960,
+				Presentation: 1_700_000_000_123_456_789,
+			},
+			payload: []byte{9, 8, 7},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := EncodeAudioPacket(test.header, test.payload)
+			if !IsAudioPacket(packet) {
+				t.Fatal("encoded packet doesn't look like an audio packet")
+			}
+
+			header, payload, err := DecodeAudioPacket(packet)
+			if err != nil {
+				t.Fatalf("decoding: %s", err)
+			}
+
+			want := test.header
+			want.Version = AudioPacketVersion
+			if header != want {
+				t.Errorf("header is %+v, want %+v", header, want)
+			}
+			if !bytes.Equal(payload, test.payload) {
+				t.Errorf("payload is %v, want %v", payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestDecodeAudioPacketErrors(t *testing.T) {
+	valid := EncodeAudioPacket(AudioPacketHeader{SessionID: 1}, []byte{1, 2})
+	badVersion := bytes.Clone(valid)
+	badVersion[1] = AudioPacketVersion + 1
+	missingPresentation := EncodeAudioPacket(AudioPacketHeader{SessionID: 1}, nil)
+	missingPresentation[3] |= AudioPacketFlagPresentation
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{name: "empty", packet: nil, err: ErrNotAudioPacket},
+		{name: "text", packet: []byte("HEARTBEAT;SESSION_ID:1"), err: ErrNotAudioPacket},
+		{name: "short header", packet: valid[:AudioPacketHeaderLen-1], err: ErrAudioPacketTooShort},
+		{name: "unknown version", packet: badVersion, err: ErrUnsupportedAudioPacketVersion},
+		{name: "missing presentation", packet: missingPresentation, err: ErrAudioPacketTooShort},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := DecodeAudioPacket(test.packet)
+			if !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSealedAudioPacketRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	toServer, err := NewPacketCipher(key, AudioDirectionToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toClient, err := NewPacketCipher(key, AudioDirectionToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := AudioPacketHeader{Format: PayloadFormatPCM16, SessionID: 5, Sequence: 11, Timestamp: 240}
+	payload := []byte{1, 2, 3, 4, 5, 6}
+	sealed := toServer.Seal(EncodeAudioPacket(header, payload))
+
+	opened, err := toServer.Open(sealed)
+	if err != nil {
+		t.Fatalf("opening: %s", err)
+	}
+	_, openedPayload, err := DecodeAudioPacket(opened)
+	if err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	if !bytes.Equal(openedPayload, payload) {
+		t.Errorf("payload is %v, want %v", openedPayload, payload)
+	}
+
+	// the other direction's nonces differ, so it can't open the packet
+	_, err = toClient.Open(sealed)
+	if err == nil {
+		t.Error("opened a packet sealed for the other direction")
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[8]++
+	_, err = toServer.Open(tampered)
+	if err == nil {
+		t.Error("opened a packet with a tampered header")
+	}
+}
@@ -0,0 +1,233 @@
+package shared
+
+import "math"
+
+// Resampler changes the sample rate of interleaved audio with a windowed sinc
+// filter. It holds on to enough input between calls that the output carries on
+// smoothly from one call to the next. Resamplers aren't thread safe
+type Resampler struct {
+	channels int
+	// taps is how many input frames on either side of an
+	// output frame the filter looks at
+	taps int
+	// ratio is how many input frames go into each output frame
+	ratio float64
+	// kernel is the filter, worked out at ResamplerPhases points between
+	// two input frames. There's one more phase than that so we can
+	// always interpolate between a phase and the next
+	kernel       [][]float32
+	coefficients []float32
+
+	// history is the input we haven't moved past yet, and position is
+	// where the next output frame falls in it, in frames
+	history  []float32
+	position float64
+	// played is what the source said the last time we pulled from it
+	played bool
+}
+
+// NewResampler creates a resampler from one sample rate to another
+func NewResampler(channels, fromRate, toRate int) *Resampler {
+	ratio := float64(fromRate) / float64(toRate)
+	// going down in rate, the filter has to cut off below
+	// the new rate's nyquist, or everything above it aliases
+	cutoff := ResamplerCutoff * min(1, 1/ratio)
+	// and it has to look at that many more input frames to
+	// cut off as sharply at the new rate as it would at the old
+	taps := int(math.Ceil(ResamplerTaps * max(1, ratio)))
+
+	kernel := make([][]float32, ResamplerPhases+1)
+	for phase := range kernel {
+		kernel[phase] = make([]float32, 2*taps)
+		offset := float64(phase) / ResamplerPhases
+
+		var total float64
+		weights := make([]float64, 2*taps)
+		for tap := range weights {
+			x := float64(tap-taps+1) - offset
+			weights[tap] = cutoff * sinc(cutoff*x) * blackman(x/float64(taps))
+			total += weights[tap]
+		}
+		// every phase lets a constant through untouched, so there's
+		// no ripple from one output frame to the next
+		for tap, weight := range weights {
+			kernel[phase][tap] = float32(weight / total)
+		}
+	}
+
+	return &Resampler{
+		channels:     channels,
+		taps:         taps,
+		ratio:        ratio,
+		kernel:       kernel,
+		coefficients: make([]float32, 2*taps),
+		// the filter looks back before the first input frame,
+		// so there's silence there to start with
+		history:  make([]float32, (taps-1)*channels),
+		position: float64(taps - 1),
+	}
+}
+
+// Ratio is how many input frames go into each output frame
+func (resampler *Resampler) Ratio() float64 {
+	return resampler.ratio
+}
+
+// SetRatio changes how many input frames go into each output frame. The filter
+// stays the same, so it's only meant for small changes
+func (resampler *Resampler) SetRatio(ratio float64) {
+	resampler.ratio = ratio
+}
+
+// Buffered is how many frames of input the resampler is holding on to
+// that it hasn't gotten to yet
+func (resampler *Resampler) Buffered() float64 {
+	return float64(len(resampler.history)/resampler.channels) - resampler.position
+}
+
+// Read fills target with resampled audio, pulling exactly as much input as
+// it needs out of source. It returns what source returns
+func (resampler *Resampler) Read(target []float32, source func(input []float32) bool) bool {
+	frames := len(target) / resampler.channels
+	if frames == 0 {
+		return resampler.played
+	}
+
+	last := resampler.position + float64(frames-1)*resampler.ratio
+	needed := int(last) + resampler.taps + 1 - len(resampler.history)/resampler.channels
+	if needed > 0 {
+		input := make([]float32, needed*resampler.channels)
+		resampler.played = source(input)
+		resampler.history = append(resampler.history, input...)
+	}
+
+	resampler.produce(target)
+	return resampler.played
+}
+
+// Resample resamples the next bit of a stream, giving back as
+// much output as the input so far is enough for
+func (resampler *Resampler) Resample(input []float32) []float32 {
+	resampler.history = append(resampler.history, input...)
+	available := len(resampler.history) / resampler.channels
+
+	frames := 0
+	for position := resampler.position; int(position)+resampler.taps < available; position += resampler.ratio {
+		frames++
+	}
+
+	output := make([]float32, frames*resampler.channels)
+	resampler.produce(output)
+	return output
+}
+
+// produce fills target from history, which has to have enough in it already
+func (resampler *Resampler) produce(target []float32) {
+	channels := resampler.channels
+	for frame := range len(target) / channels {
+		index := int(resampler.position)
+		phase := (resampler.position - float64(index)) * ResamplerPhases
+		lowerPhase := int(phase)
+		blend := float32(phase - float64(lowerPhase))
+		lower, upper := resampler.kernel[lowerPhase], resampler.kernel[lowerPhase+1]
+		for tap := range resampler.coefficients {
+			resampler.coefficients[tap] = lower[tap] + (upper[tap]-lower[tap])*blend
+		}
+
+		start := (index - resampler.taps + 1) * channels
+		for ch := range channels {
+			var sum float32
+			for tap, coefficient := range resampler.coefficients {
+				sum += coefficient * resampler.history[start+tap*channels+ch]
+			}
+			target[frame*channels+ch] = sum
+		}
+
+		resampler.position += resampler.ratio
+	}
+
+	// let go of the input the filter won't look at again
+	drop := min(int(resampler.position)-resampler.taps+1, len(resampler.history)/channels)
+	if drop > 0 {
+		resampler.history = append(resampler.history[:0], resampler.history[drop*channels:]...)
+		resampler.position -= float64(drop)
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window, which goes from 1 at 0 to 0 at -1 and 1
+func blackman(x float64) float64 {
+	if math.Abs(x) >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+// FormatConverter converts audio from one format to another, remixing its
+// channels and resampling it. Converters aren't thread safe
+type FormatConverter struct {
+	from AudioFormat
+	to   AudioFormat
+	// resampler is nil when the sample rates are the same
+	resampler *Resampler
+}
+
+// NewFormatConverter creates a converter from one format to another
+func NewFormatConverter(from, to AudioFormat) *FormatConverter {
+	converter := &FormatConverter{from: from, to: to}
+	if from.SampleRate != to.SampleRate {
+		converter.resampler = NewResampler(converter.resampleChannels(), from.SampleRate, to.SampleRate)
+	}
+
+	return converter
+}
+
+// resampleChannels is the channel count we resample in. Channels are remixed
+// on whichever side of the resampler has fewer of them, so there's less to resample
+func (converter *FormatConverter) resampleChannels() int {
+	return min(converter.from.Channels, converter.to.Channels)
+}
+
+// Convert converts the next bit of a stream
+func (converter *FormatConverter) Convert(samples []float32) []float32 {
+	samples = RemixChannels(samples, converter.from.Channels, converter.resampleChannels())
+	if converter.resampler != nil {
+		samples = converter.resampler.Resample(samples)
+	}
+
+	return RemixChannels(samples, converter.resampleChannels(), converter.to.Channels)
+}
+
+// Read fills target with audio in the format we convert to, pulling
+// audio in the format we convert from out of source
+func (converter *FormatConverter) Read(target []float32, source func(input []float32) bool) bool {
+	channels := converter.resampleChannels()
+	// pull pulls audio out of source in the channels we resample in
+	pull := func(input []float32) bool {
+		if converter.from.Channels == channels {
+			return source(input)
+		}
+
+		raw := make([]float32, len(input)/channels*converter.from.Channels)
+		played := source(raw)
+		copy(input, RemixChannels(raw, converter.from.Channels, channels))
+		return played
+	}
+
+	converted := make([]float32, len(target)/converter.to.Channels*channels)
+	var played bool
+	if converter.resampler != nil {
+		played = converter.resampler.Read(converted, pull)
+	} else {
+		played = pull(converted)
+	}
+
+	copy(target, RemixChannels(converted, channels, converter.to.Channels))
+	return played
+}
@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// tone is a second of a sine wave at a frequency
+func tone(frequency float64, sampleRate int) []float32 {
+	samples := make([]float32, sampleRate)
+	for i := range samples {
+		samples[i] = float32(math.Sin(2 * math.Pi * frequency * float64(i) / float64(sampleRate)))
+	}
+	return samples
+}
+
+// peakDB is the loudest sample, in decibels, once the filter's settled
+func peakDB(samples []float32) float64 {
+	var peak float64
+	for _, sample := range samples[len(samples)/10 : len(samples)-len(samples)/10] {
+		peak = max(peak, math.Abs(float64(sample)))
+	}
+	return 20 * math.Log10(peak)
+}
+
+func TestResamplerLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		fromRate int
+		toRate   int
+	}{
+		{name: "down", fromRate: 48000, toRate: 44100},
+		{name: "up", fromRate: 44100, toRate: 48000},
+		{name: "same", fromRate: 48000, toRate: 48000},
+		{name: "phone", fromRate: 48000, toRate: 8000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := NewResampler(1, test.fromRate, test.toRate).Resample(make([]float32, test.fromRate))
+			// the filter holds back its taps until it sees what comes after them
+			taps := math.Ceil(ResamplerTaps * max(1, float64(test.fromRate)/float64(test.toRate)))
+			want := test.toRate - int(taps)*test.toRate/test.fromRate
+			if math.Abs(float64(len(output)-want)) > 1 {
+				t.Errorf("got %d frames, want %d", len(output), want)
+			}
+		})
+	}
+}
+
+func TestResamplerFrequencyResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		frequency float64
+		fromRate  int
+		toRate    int
+		// minDB and maxDB are where the tone's level has to end up
+		minDB float64
+		maxDB float64
+	}{
+		{name: "passband", frequency: 1000, fromRate: 48000, toRate: 44100, minDB: -0.1, maxDB: 0.1},
+		{name: "top of passband", frequency: 18000, fromRate: 48000, toRate: 44100, minDB: -0.5, maxDB: 0.1},
+		{name: "above new nyquist", frequency: 23000, fromRate: 48000, toRate: 44100, minDB: math.Inf(-1), maxDB: -60},
+		{name: "old nyquist", frequency: 23900, fromRate: 48000, toRate: 44100, minDB: math.Inf(-1), maxDB: -60},
+		{name: "above phone nyquist", frequency: 5000, fromRate: 48000, toRate: 8000, minDB: math.Inf(-1), maxDB: -60},
+		{name: "up passband", frequency: 1000, fromRate: 44100, toRate: 48000, minDB: -0.1, maxDB: 0.1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := NewResampler(1, test.fromRate, test.toRate).Resample(tone(test.frequency, test.fromRate))
+			level := peakDB(output)
+			if level < test.minDB || level > test.maxDB {
+				t.Errorf("%v Hz came out at %.1f dB, want between %.1f and %.1f", test.frequency, level, test.minDB, test.maxDB)
+			}
+		})
+	}
+}
+
+func TestResamplerChunks(t *testing.T) {
+	input := tone(440, 48000)
+	whole := NewResampler(1, 48000, 44100).Resample(input)
+
+	resampler := NewResampler(1, 48000, 44100)
+	var chunked []float32
+	for chunk := range slices.Chunk(input, 241) {
+		chunked = append(chunked, resampler.Resample(chunk)...)
+	}
+
+	// where the resampler's up to gets rounded differently, so
+	// it's only ever the same to within float32 precision
+	if len(chunked) != len(whole) {
+		t.Fatalf("got %d frames in chunks, %d all at once", len(chunked), len(whole))
+	}
+	for i := range whole {
+		if math.Abs(float64(whole[i]-chunked[i])) > 1e-5 {
+			t.Fatalf("frame %d is %v in chunks, %v all at once", i, chunked[i], whole[i])
+		}
+	}
+}
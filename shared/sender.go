@@ -0,0 +1,113 @@
+package shared
+
+import "time"
+
+// AudioSender turns a continuous stream of audio into audio packets
+type AudioSender interface {
+	// Packetize encodes the next samples of the stream into packets
+	// ready to go out on the network
+	Packetize(samples []float32) [][]byte
+	// PacketizeAt is Packetize for samples whose first frame is meant to be
+	// played at presentation. Every packet is stamped with when its own
+	// first frame is meant to be played
+	PacketizeAt(samples []float32, presentation time.Time) [][]byte
+}
+
+type audioSender struct {
+	codec     Codec
+	cipher    PacketCipher
+	sessionID uint32
+	format    AudioFormat
+	// packetFrames is how many frames go in every packet
+	packetFrames int
+
+	// pending are the samples that didn't fill a whole packet
+	// yet. They go out at the front of the next one
+	pending   []float32
+	sequence  uint32
+	timestamp uint64
+}
+
+// NewAudioSender creates a new audio sender. Every packet holds packetDuration
+// of audio, split on whole frames, however the audio comes in. Durations that
+// won't fit in a network packet are cut down to the most that will. If cipher
+// isn't nil, every packet is sealed with it. Senders aren't thread safe,
+// they're meant to be fed from a single audio callback
+func NewAudioSender(
+	codec Codec,
+	cipher PacketCipher,
+	sessionID uint32,
+	format AudioFormat,
+	packetDuration time.Duration,
+) AudioSender {
+	return &audioSender{
+		codec:        codec,
+		cipher:       cipher,
+		sessionID:    sessionID,
+		format:       format,
+		packetFrames: PacketFrames(codec, format, packetDuration),
+	}
+}
+
+// PacketFrames is how many frames go in a packet holding packetDuration of audio.
+// It's at least one frame, and no more than fits in a network packet. Uncompressed
+// audio doesn't fit much, float32 stereo at 48kHz is capped at about 3.6ms
+func PacketFrames(codec Codec, format AudioFormat, packetDuration time.Duration) int {
+	if packetDuration <= 0 {
+		packetDuration = DefaultPacketDuration
+	}
+	frames := DurationFrames(min(packetDuration, MaxPacketDuration), format.SampleRate)
+	return max(min(frames, codec.MaxFrames(NetworkPacketSizeBytes)), 1)
+}
+
+// PacketDurationCapped tells you if PacketFrames had to cut packetDuration down
+// to fit it in a packet, so whoever asked for it can be told they aren't getting it
+func PacketDurationCapped(codec Codec, format AudioFormat, packetDuration time.Duration) bool {
+	return DurationFrames(packetDuration, format.SampleRate) > PacketFrames(codec, format, packetDuration)
+}
+
+func (sender *audioSender) Packetize(samples []float32) [][]byte {
+	return sender.packetize(samples, time.Time{})
+}
+
+func (sender *audioSender) PacketizeAt(samples []float32, presentation time.Time) [][]byte {
+	return sender.packetize(samples, presentation)
+}
+
+// packetize splits samples up into whole packets, holding on to whatever's
+// left over for next time. They're only stamped with presentation times
+// if presentation isn't zero
+func (sender *audioSender) packetize(samples []float32, presentation time.Time) [][]byte {
+	channels := sender.format.Channels
+	// whatever was left over last time is played right before samples
+	frames := -len(sender.pending) / channels
+	sender.pending = append(sender.pending, samples...)
+
+	var packets [][]byte
+	packetLen := sender.packetFrames * channels
+	offset := 0
+	for ; len(sender.pending)-offset >= packetLen; offset += packetLen {
+		header := AudioPacketHeader{
+			Format:    sender.codec.Format(),
+			SessionID: sender.sessionID,
+			Sequence:  sender.sequence,
+			Timestamp: sender.timestamp,
+		}
+		if !presentation.IsZero() {
+			header.Flags |= AudioPacketFlagPresentation
+			header.Presentation = presentation.Add(FramesDuration(frames, sender.format.SampleRate)).UnixNano()
+		}
+		packet := EncodeAudioPacket(header, sender.codec.Encode(sender.pending[offset:offset+packetLen]))
+		if sender.cipher != nil {
+			packet = sender.cipher.Seal(packet)
+		}
+		packets = append(packets, packet)
+
+		sender.sequence++
+		sender.timestamp += uint64(sender.packetFrames)
+		frames += sender.packetFrames
+	}
+	sender.pending = append(sender.pending[:0], sender.pending[offset:]...)
+
+	return packets
+}
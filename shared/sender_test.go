@@ -0,0 +1,39 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacketFrames(t *testing.T) {
+	stereo := AudioFormat{SampleRate: 48000, Channels: 2}
+	tests := []struct {
+		name     string
+		format   PayloadFormat
+		duration time.Duration
+		frames   int
+		capped   bool
+	}{
+		{name: "default", format: PayloadFormatPCM16, duration: 0, frames: 240},
+		{name: "fits", format: PayloadFormatPCM16, duration: 5 * time.Millisecond, frames: 240},
+		{name: "float32 fills the packet", format: PayloadFormatFloat32, duration: 5 * time.Millisecond, frames: 175, capped: true},
+		{name: "pcm16 fills the packet", format: PayloadFormatPCM16, duration: 10 * time.Millisecond, frames: 350, capped: true},
+		{name: "longer than the most we send", format: PayloadFormatIMAADPCM, duration: time.Second, frames: 960, capped: true},
+		{name: "shorter than a frame", format: PayloadFormatPCM16, duration: time.Microsecond, frames: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec, err := NewCodec(test.format, stereo.Channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frames := PacketFrames(codec, stereo, test.duration); frames != test.frames {
+				t.Errorf("got %d frames, want %d", frames, test.frames)
+			}
+			if capped := PacketDurationCapped(codec, stereo, test.duration); capped != test.capped {
+				t.Errorf("capped is %v, want %v", capped, test.capped)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package shared
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AudioStream is a continuous stream of audio coming in from the network
+type AudioStream interface {
+	// Push adds a packet that arrived from the network. It returns false
+	// if the packet was dropped
+	Push(header AudioPacketHeader, samples []float32, arrival time.Time) bool
+	// ReadInto fills target with the next interleaved samples of the stream.
+	// It returns false if the stream had nothing to play and target is silence
+	ReadInto(target []float32) bool
+	// FadeOut fades whatever the stream has left to play out to silence.
+	// Once it's faded out, the stream only plays silence
+	FadeOut()
+	// Stats returns the stream's counters
+	Stats() StreamStats
+	// Presentation is when the next frame ReadInto gives back is meant to be
+	// played, on the sender's clock. It's false if the sender doesn't say.
+	// Only whoever reads the stream can call it
+	Presentation() (time.Time, bool)
+}
+
+// StreamStats are the running counters of an audio stream
+type StreamStats struct {
+	JitterStats
+	// LossEvents is the amount of times the stream had to start
+	// concealing a hole
+	LossEvents uint64 `json:"lossEvents"`
+	// ConcealedFrames is the amount of frames that were made up
+	// by loss concealment
+	ConcealedFrames uint64 `json:"concealedFrames"`
+	// DriftPPM is how much faster the sender's clock runs than ours, in
+	// parts per million. It's only measured by drift compensated streams
+	DriftPPM float64 `json:"driftPPM"`
+}
+
+type audioStream struct {
+	channels   int
+	sampleRate int
+	jitter     JitterBuffer
+	concealer  LossConcealer
+
+	// the counters are only written by the reader, but anyone can read them
+	lossEvents      atomic.Uint64
+	concealedFrames atomic.Uint64
+	concealing      bool
+
+	// fadeRequested is set by FadeOut and picked up by the reader, who
+	// then counts fadeLeft down to silence
+	fadeRequested atomic.Bool
+	fading        bool
+	fadeLeft      int
+
+	// pending is what's left of the last packet after the previous read.
+	// It's only ever touched by the reader
+	pending []float32
+	// presentation is when the last packet with a presentation time was
+	// meant to be played, and presentationFrames is how many frames we've
+	// played since. They're only ever touched by the reader
+	presentation       int64
+	presentationFrames int
+}
+
+// NewAudioStream creates a new audio stream that plays out of a jitter buffer
+func NewAudioStream(channels, sampleRate int) AudioStream {
+	return &audioStream{
+		channels:   channels,
+		sampleRate: sampleRate,
+		jitter: NewJitterBuffer(
+			channels,
+			sampleRate,
+			JitterBufferMinDepthFrames,
+			JitterBufferMaxDepthFrames,
+		),
+		concealer: NewLossConcealer(channels),
+	}
+}
+
+func (stream *audioStream) Push(header AudioPacketHeader, samples []float32, arrival time.Time) bool {
+	return stream.jitter.Push(header, samples, arrival)
+}
+
+func (stream *audioStream) ReadInto(target []float32) bool {
+	if stream.fadeRequested.Swap(false) && !stream.fading {
+		stream.fading = true
+		stream.fadeLeft = StreamFadeOutFrames
+	}
+	if stream.fading {
+		if stream.fadeLeft == 0 {
+			ZeroSlice(target)
+			return false
+		}
+
+		played := stream.read(target)
+		stream.fade(target)
+		return played
+	}
+
+	return stream.read(target)
+}
+
+// read fills target with the next samples of the stream
+func (stream *audioStream) read(target []float32) bool {
+	written := 0
+	played := false
+	for written < len(target) {
+		if len(stream.pending) == 0 {
+			packet, status := stream.jitter.Pop()
+			switch status {
+			case JitterStatusOK:
+				stream.pending = stream.concealer.Recover(packet.Samples)
+				stream.concealing = false
+				if packet.Presentation != 0 {
+					stream.presentation = packet.Presentation
+					stream.presentationFrames = 0
+				}
+			case JitterStatusLost:
+				// Fill the hole so the rest of the stream stays in time
+				stream.pending = stream.conceal(packet.Frames)
+				continue
+			default:
+				// We ran dry. Keep concealing until the concealment
+				// fades out, then go quiet until the buffer refills
+				if !stream.concealer.Concealing() {
+					// we don't know when the audio after the
+					// gap is meant to be played until it's here
+					stream.presentation = 0
+					ZeroSlice(target[written:])
+					return played
+				}
+				remaining := target[written:]
+				copy(remaining, stream.conceal(len(remaining)/stream.channels))
+				stream.presentationFrames += len(remaining) / stream.channels
+				return true
+			}
+		}
+
+		n := copy(target[written:], stream.pending)
+		stream.pending = stream.pending[n:]
+		written += n
+		stream.presentationFrames += n / stream.channels
+		played = true
+	}
+
+	return played
+}
+
+func (stream *audioStream) Presentation() (time.Time, bool) {
+	if stream.presentation == 0 {
+		return time.Time{}, false
+	}
+
+	presentation := time.Unix(0, stream.presentation)
+	return presentation.Add(FramesDuration(stream.presentationFrames, stream.sampleRate)), true
+}
+
+func (stream *audioStream) FadeOut() {
+	stream.fadeRequested.Store(true)
+}
+
+// fade applies the next bit of the fade out to target
+func (stream *audioStream) fade(target []float32) {
+	for frame := range len(target) / stream.channels {
+		gain := float32(stream.fadeLeft) / StreamFadeOutFrames
+		for ch := range stream.channels {
+			target[frame*stream.channels+ch] *= gain
+		}
+		if stream.fadeLeft > 0 {
+			stream.fadeLeft--
+		}
+	}
+}
+
+func (stream *audioStream) Stats() StreamStats {
+	return StreamStats{
+		JitterStats:     stream.jitter.Stats(),
+		LossEvents:      stream.lossEvents.Load(),
+		ConcealedFrames: stream.concealedFrames.Load(),
+	}
+}
+
+// conceal makes up frames of audio to cover a hole and keeps count of it
+func (stream *audioStream) conceal(frames int) []float32 {
+	if !stream.concealing {
+		stream.concealing = true
+		stream.lossEvents.Add(1)
+	}
+	stream.concealedFrames.Add(uint64(frames))
+	return stream.concealer.Conceal(frames)
+}
@@ -0,0 +1,347 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamNotConnected is returned when writing to a stream connection that
+// lost its stream and hasn't gotten it back yet
+var ErrStreamNotConnected = errors.New("stream is not connected")
+
+// Transport is how a client's packets get to the server
+type Transport string
+
+const (
+	// TransportUDP sends every packet as a UDP datagram
+	TransportUDP Transport = "udp"
+	// TransportTCP sends packets over a single TCP connection
+	TransportTCP Transport = "tcp"
+	// TransportWebSocket sends packets over a single WebSocket
+	TransportWebSocket Transport = "websocket"
+)
+
+// StreamAddr is the address of the peer on the other end of a stream connection
+type StreamAddr struct {
+	// Transport is the stream's transport
+	Transport Transport
+	// Addr is the peer's address
+	Addr string
+}
+
+func (addr StreamAddr) Network() string {
+	return string(addr.Transport)
+}
+
+// String has the transport in it, so a stream can never be mistaken
+// for a UDP peer on the same address
+func (addr StreamAddr) String() string {
+	return fmt.Sprintf("%s://%s", addr.Transport, addr.Addr)
+}
+
+// StreamConn carries packets over a stream, like a TCP connection or a WebSocket,
+// by putting each packet's length in front of it. It's a net.PacketConn, so the
+// same messages and audio packets that go over UDP can go over a stream too.
+// Every packet comes from, and goes to, the peer on the other end
+type StreamConn struct {
+	addr StreamAddr
+	// dial gets a new stream when the last one breaks. It's nil for
+	// streams that were accepted, which are done once they break
+	dial func() (net.Conn, error)
+
+	// mu guards stream and writing
+	mu     sync.Mutex
+	stream net.Conn
+	// writing is closed once the stream's writer is done
+	writing chan struct{}
+
+	frames chan []byte
+	// outgoing are the packets waiting for the writer
+	outgoing  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// readDeadline is in unix nanoseconds, 0 means no deadline
+	readDeadline atomic.Int64
+	// dropping is whether the peer has stopped keeping up
+	dropping atomic.Bool
+}
+
+// NewStreamConn carries packets over a stream that was accepted. Once the
+// stream breaks, the connection is closed
+func NewStreamConn(stream net.Conn, addr StreamAddr) *StreamConn {
+	conn := newStreamConn(addr, nil)
+	conn.stream = stream
+	conn.writing = make(chan struct{})
+	go conn.writeFrames(stream, nil, conn.writing)
+	go func() {
+		conn.readFrames(stream)
+		conn.Close()
+	}()
+
+	return conn
+}
+
+// DialStreamConn carries packets over a stream that it dials, and dials again
+// whenever it breaks. Packets written while there's no stream are dropped, the
+// same as they would be over UDP
+func DialStreamConn(addr StreamAddr, dial func() (net.Conn, error)) *StreamConn {
+	conn := newStreamConn(addr, dial)
+	go conn.redial()
+
+	return conn
+}
+
+func newStreamConn(addr StreamAddr, dial func() (net.Conn, error)) *StreamConn {
+	return &StreamConn{
+		addr:     addr,
+		dial:     dial,
+		frames:   make(chan []byte, StreamFrameQueueLen),
+		outgoing: make(chan []byte, StreamSendQueueLen),
+		closed:   make(chan struct{}),
+	}
+}
+
+// RemoteAddr is the address of the peer on the other end
+func (conn *StreamConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *StreamConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline := conn.readDeadline.Load(); deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case frame := <-conn.frames:
+		return copy(b, frame), conn.addr, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo queues a packet for the stream's writer. It never blocks, if the
+// peer isn't keeping up and the queue is full the packet's dropped, the same
+// as it would be over UDP. Real-time audio would rather lose a packet than wait
+func (conn *StreamConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if len(b) > MaxStreamFrameLen {
+		return 0, fmt.Errorf("packet is too big for a stream frame: %d bytes", len(b))
+	}
+
+	frame := make([]byte, StreamFrameHeaderLen+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[StreamFrameHeaderLen:], b)
+
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	conn.mu.Lock()
+	connected := conn.stream != nil
+	conn.mu.Unlock()
+	if !connected {
+		return 0, ErrStreamNotConnected
+	}
+
+	select {
+	case conn.outgoing <- frame:
+		conn.dropping.Store(false)
+	default:
+		if !conn.dropping.Swap(true) {
+			fmt.Printf("%s isn't keeping up, dropping packets\n", conn.addr)
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close gives the writer up to StreamWriteTimeout to send what's still
+// queued, so a goodbye written just before closing still gets there
+func (conn *StreamConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+
+	conn.mu.Lock()
+	writing := conn.writing
+	conn.mu.Unlock()
+	if writing != nil {
+		select {
+		case <-writing:
+		case <-time.After(StreamWriteTimeout):
+		}
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.stream != nil {
+		return conn.stream.Close()
+	}
+	return nil
+}
+
+func (conn *StreamConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *StreamConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *StreamConn) SetReadDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	conn.readDeadline.Store(deadline)
+	return nil
+}
+
+// SetWriteDeadline does nothing, since WriteTo never blocks. The writer
+// gives each write to the stream StreamWriteTimeout instead
+func (conn *StreamConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// redial keeps a stream going until the connection is closed
+func (conn *StreamConn) redial() {
+	for {
+		select {
+		case <-conn.closed:
+			return
+		default:
+		}
+
+		stream, err := conn.dial()
+		if err != nil {
+			fmt.Printf("error connecting to %s: %s\n", conn.addr, err.Error())
+			select {
+			case <-conn.closed:
+				return
+			case <-time.After(StreamRedialDelay):
+				continue
+			}
+		}
+
+		conn.mu.Lock()
+		select {
+		case <-conn.closed:
+			conn.mu.Unlock()
+			stream.Close()
+			return
+		default:
+		}
+		broken := make(chan struct{})
+		writing := make(chan struct{})
+		conn.stream = stream
+		conn.writing = writing
+		conn.mu.Unlock()
+		go conn.writeFrames(stream, broken, writing)
+
+		conn.readFrames(stream)
+
+		close(broken)
+		conn.mu.Lock()
+		conn.stream = nil
+		conn.mu.Unlock()
+		stream.Close()
+		<-writing
+
+		// anything still queued is too old to be worth sending on the next stream
+		conn.drainOutgoing()
+	}
+}
+
+// writeFrames writes queued packets to the stream until it breaks or the
+// connection's closed. Every write gets StreamWriteTimeout, so a peer that
+// stops reading ends up with a broken stream rather than a writer stuck forever
+func (conn *StreamConn) writeFrames(stream net.Conn, broken <-chan struct{}, writing chan<- struct{}) {
+	defer close(writing)
+	for {
+		select {
+		case frame := <-conn.outgoing:
+			if !writeFrame(stream, frame) {
+				return
+			}
+		case <-broken:
+			return
+		case <-conn.closed:
+			for {
+				select {
+				case frame := <-conn.outgoing:
+					if !writeFrame(stream, frame) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeFrame writes a frame to the stream, closing the stream if it can't.
+// The reader notices the stream is gone and gets a new one if it can
+func writeFrame(stream net.Conn, frame []byte) bool {
+	stream.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	_, err := stream.Write(frame)
+	if err != nil {
+		stream.Close()
+		return false
+	}
+	return true
+}
+
+// drainOutgoing throws away whatever's waiting for the writer
+func (conn *StreamConn) drainOutgoing() {
+	for {
+		select {
+		case <-conn.outgoing:
+		default:
+			return
+		}
+	}
+}
+
+// readFrames reads packets off the stream until it breaks
+func (conn *StreamConn) readFrames(stream net.Conn) {
+	reader := bufio.NewReader(stream)
+	header := make([]byte, StreamFrameHeaderLen)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(header))
+		if length > MaxStreamFrameLen {
+			fmt.Printf("stream frame from %s is too big: %d bytes\n", conn.addr, length)
+			return
+		}
+
+		frame := make([]byte, length)
+		_, err = io.ReadFull(reader, frame)
+		if err != nil {
+			return
+		}
+
+		select {
+		case conn.frames <- frame:
+		case <-conn.closed:
+			return
+		}
+	}
+}
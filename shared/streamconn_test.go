@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamConnRoundTrip(t *testing.T) {
+	left, right := net.Pipe()
+	addr := StreamAddr{Transport: TransportTCP, Addr: "peer"}
+	sender := NewStreamConn(left, addr)
+	receiver := NewStreamConn(right, addr)
+	defer sender.Close()
+	defer receiver.Close()
+
+	packets := [][]byte{{1, 2, 3}, {}, bytes.Repeat([]byte{7}, MaxStreamFrameLen)}
+	for _, packet := range packets {
+		_, err := sender.WriteTo(packet, addr)
+		if err != nil {
+			t.Fatalf("writing: %s", err)
+		}
+	}
+
+	buffer := make([]byte, MaxStreamFrameLen)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range packets {
+		n, _, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("reading: %s", err)
+		}
+		if !bytes.Equal(buffer[:n], want) {
+			t.Errorf("read %d bytes, want %d", n, len(want))
+		}
+	}
+}
+
+func TestStreamConnStalledPeer(t *testing.T) {
+	// nothing ever reads the other end of the pipe, so
+	// every write to it blocks until it times out
+	stream, peer := net.Pipe()
+	defer peer.Close()
+	conn := NewStreamConn(stream, StreamAddr{Transport: TransportTCP, Addr: "stalled"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range StreamSendQueueLen * 4 {
+			conn.WriteTo([]byte{1, 2, 3}, nil)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writes to a stalled peer blocked")
+	}
+	conn.Close()
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ClockSync works out how far our clock is from the server's, the way NTP does.
+// Samples are only added by one goroutine, but anyone can ask what time it is
+type ClockSync struct {
+	samples []clockSample
+	// offset is how far ahead of our clock the server's is
+	offset atomic.Int64
+	synced atomic.Bool
+}
+
+type clockSample struct {
+	offset time.Duration
+	delay  time.Duration
+}
+
+// NewClockSync creates a clock sync that hasn't synced yet
+func NewClockSync() *ClockSync {
+	return &ClockSync{}
+}
+
+// AddSample adds an exchange with the server: when we sent our message (t1), when
+// the server got it (t2), when the server answered (t3), and when we got the
+// answer (t4). t2 and t3 are on the server's clock, the others are on ours
+func (sync *ClockSync) AddSample(t1, t2, t3, t4 time.Time) {
+	sample := clockSample{
+		offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		delay:  t4.Sub(t1) - t3.Sub(t2),
+	}
+	if sample.delay < 0 {
+		return
+	}
+
+	sync.samples = append(sync.samples, sample)
+	if len(sync.samples) > ClockSyncSamples {
+		sync.samples = sync.samples[1:]
+	}
+
+	// the exchange that took the least time had the
+	// least room for the network to throw it off
+	best := slices.MinFunc(sync.samples, func(a, b clockSample) int {
+		return int(a.delay - b.delay)
+	})
+	sync.offset.Store(int64(best.offset))
+	sync.synced.Store(true)
+}
+
+// Now is what time it is on the server's clock. It's false
+// until we've had at least one exchange with the server
+func (sync *ClockSync) Now() (time.Time, bool) {
+	if !sync.synced.Load() {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(sync.offset.Load())), true
+}
+
+// syncedStream plays a stream stamped with presentation times so every frame
+// comes out of the device when it's meant to, going by the server's clock. That's
+// what keeps every room playing the mix at the same time. Small offsets are played
+// out by nudging the rate we play at, big ones are jumped over
+type syncedStream struct {
+	AudioStream
+	format     AudioFormat
+	clock      *ClockSync
+	resampler  *Resampler
+	controller driftController
+}
+
+// NewSyncedStream wraps a stream so it plays in step with its presentation times
+func NewSyncedStream(stream AudioStream, format AudioFormat, clock *ClockSync) AudioStream {
+	return &syncedStream{
+		AudioStream: stream,
+		format:      format,
+		clock:       clock,
+		resampler:   NewResampler(format.Channels, format.SampleRate, format.SampleRate),
+	}
+}
+
+func (stream *syncedStream) ReadInto(target []float32) bool {
+	channels := stream.format.Channels
+	frames := len(target) / channels
+	offset, ok := stream.offset(frames)
+	if !ok {
+		stream.controller.reset()
+		stream.resampler.SetRatio(1)
+		return stream.resampler.Read(target, stream.AudioStream.ReadInto)
+	}
+
+	switch {
+	case offset > SyncMaxOffset:
+		// we're early, so we wait with silence until it's time
+		stream.controller.reset()
+		wait := min(DurationFrames(offset, stream.format.SampleRate), frames)
+		ZeroSlice(target[:wait*channels])
+		if wait == frames {
+			return false
+		}
+		return stream.resampler.Read(target[wait*channels:], stream.AudioStream.ReadInto)
+	case offset < -SyncMaxOffset:
+		// we're late, so we throw away whatever we should've played by now
+		stream.controller.reset()
+		behind := min(DurationFrames(-offset, stream.format.SampleRate), JitterBufferMaxDepthFrames)
+		stream.resampler.Read(make([]float32, behind*channels), stream.AudioStream.ReadInto)
+	default:
+		// a device running fast gets ahead of the presentation
+		// times, so we play a little less audio for every frame of ours
+		elapsed := float64(frames) / float64(stream.format.SampleRate)
+		stream.resampler.SetRatio(1 - stream.controller.update(offset.Seconds(), elapsed))
+	}
+
+	return stream.resampler.Read(target, stream.AudioStream.ReadInto)
+}
+
+// offset is how far ahead of its presentation time the next frame we play
+// would be. It's false if we don't know the server's time, or the stream
+// doesn't have presentation times
+func (stream *syncedStream) offset(frames int) (time.Duration, bool) {
+	now, ok := stream.clock.Now()
+	if !ok {
+		return 0, false
+	}
+	presentation, ok := stream.AudioStream.Presentation()
+	if !ok {
+		return 0, false
+	}
+
+	// the resampler is holding on to frames that come before the
+	// stream's next one, and we play those first
+	held := time.Duration(stream.resampler.Buffered() * float64(time.Second) / float64(stream.format.SampleRate))
+	// what we write now plays once the device is done with what it's playing now
+	playsAt := now.Add(FramesDuration(frames, stream.format.SampleRate))
+	return presentation.Add(-held).Sub(playsAt), true
+}
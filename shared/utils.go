@@ -2,11 +2,13 @@ package shared
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"iter"
 	"strconv"
 	"strings"
+	"unsafe"
 )
 
 // ShouldKillCtx easily tells you if your context has been canceled
@@ -65,6 +67,8 @@ func IdentifyServerAction(message string) ServerAction {
 		return ServerActionDiscover
 	case ClientIdentificationKeyword:
 		fallthrough
+	case ClientAuthChallengeKeyword:
+		fallthrough
 	case ClientIdentificationResponse:
 		return ServerActionIdentification
 	default:
@@ -72,119 +76,362 @@ func IdentifyServerAction(message string) ServerAction {
 	}
 }
 
-// CraftServerDiscoveryResponse creates the server positive response
-// including the port number
-func CraftServerDiscoveryResponse(port int) []byte {
-	return []byte(joinParts(ServerDiscoveryResponse, strconv.FormatInt(int64(port), 10)))
+// CraftServerDiscoveryRequest puts together the message a client broadcasts
+// to find the server
+func CraftServerDiscoveryRequest(versions ProtocolVersionRange) []byte {
+	return []byte(joinParts(ServerDiscoveryKeyword, joinItems(ProtocolVersionsKey, versions.String())))
+}
+
+// ReadServerDiscoveryRequest reads a client's discovery request and returns a
+// boolean flag if this was indeed a discovery request, and the protocol versions
+// the client speaks
+func ReadServerDiscoveryRequest(message string) (bool, ProtocolVersionRange, error) {
+	parts := strings.Split(message, ServerMessagePartsDelimiter)
+	if parts[0] != ServerDiscoveryKeyword {
+		return false, ProtocolVersionRange{}, nil
+	}
+
+	versions, err := readProtocolVersions(readItems(parts[1:]))
+	return true, versions, err
+}
+
+// CraftServerDiscoveryResponse creates the server response including the port
+// number. Responses without protocol versions are what clients from before
+// version negotiation expect
+func CraftServerDiscoveryResponse(response DiscoveryResponse) []byte {
+	parts := []string{
+		ServerDiscoveryResponse,
+		strconv.FormatInt(int64(response.Port), 10),
+	}
+	if response.ProtocolVersions.Max > 0 {
+		parts = append(parts, joinItems(ProtocolVersionsKey, response.ProtocolVersions.String()))
+	}
+	if response.ProtocolVersion > 0 {
+		parts = append(parts, joinItems(ProtocolVersionKey, strconv.Itoa(response.ProtocolVersion)))
+	}
+	if response.Reason != "" {
+		parts = append(parts, joinItems(ClientIdentificationReasonKey, string(response.Reason)))
+	}
+	if response.Name != "" {
+		parts = append(parts, joinItems(ServerNameKey, response.Name))
+	}
+	if response.ID != "" {
+		parts = append(parts, joinItems(ServerIDKey, response.ID))
+	}
+
+	return []byte(joinParts(parts...))
 }
 
 // ReadServerDiscoveryResponse reads the response and returns a
-// bool telling you if that is the correct message, and the port
-// that is included in the message
-func ReadServerDiscoveryResponse(resp string) (bool, int, error) {
+// bool telling you if that is the correct message, and what the
+// server told us
+func ReadServerDiscoveryResponse(resp string) (bool, DiscoveryResponse, error) {
 	parts := strings.Split(resp, ServerMessagePartsDelimiter)
-	if len(parts) != 2 {
-		return false, 0, nil
+	if len(parts) < 2 {
+		return false, DiscoveryResponse{}, nil
 	}
 
 	if parts[0] != ServerDiscoveryResponse {
-		return false, 0, nil
+		return false, DiscoveryResponse{}, nil
 	}
 
 	port, err := strconv.Atoi(parts[1])
-	return true, port, err
+	if err != nil {
+		return true, DiscoveryResponse{}, err
+	}
+	items := readItems(parts[2:])
+
+	versions, err := readProtocolVersions(items)
+	if err != nil {
+		return true, DiscoveryResponse{}, err
+	}
+	response := DiscoveryResponse{
+		Port:             port,
+		ProtocolVersions: versions,
+		ProtocolVersion:  versions.Max,
+		Reason:           RejectionReason(items[ClientIdentificationReasonKey]),
+		Name:             items[ServerNameKey],
+		ID:               items[ServerIDKey],
+	}
+	if versionStr, ok := items[ProtocolVersionKey]; ok {
+		response.ProtocolVersion, err = strconv.Atoi(versionStr)
+		if err != nil {
+			return true, DiscoveryResponse{}, err
+		}
+	}
+
+	return true, response, nil
 }
 
 // CraftClientIdentificationMessage puts together a client identification message
-func CraftClientIdentificationMessage(name string, capabilities []int) []byte {
-	capabilitiesStr := strings.Join(Map(capabilities, func(capability int) string {
-		return strconv.FormatInt(int64(capability), 10)
-	}), ",")
+func CraftClientIdentificationMessage(identification ClientIdentification) []byte {
+	capabilities := Map(identification.Capabilities, func(capability ClientCapability) int {
+		return int(capability)
+	})
+	payloadFormats := Map(identification.PayloadFormats, func(format PayloadFormat) int {
+		return int(format)
+	})
 
 	// Non-AI proof. Only a human could make code so disgusting
-	return []byte(joinParts(
+	parts := []string{
 		ClientIdentificationKeyword,
-		joinItems(ClientIdentificationNameKey, name),
-		joinItems(ClientIdentificationCapabilitiesKey, capabilitiesStr),
+		joinItems(ClientIdentificationNameKey, identification.Name),
+		joinItems(ClientIdentificationCapabilitiesKey, joinInts(capabilities)),
+		joinItems(ClientIdentificationPayloadFormatsKey, joinInts(payloadFormats)),
+		joinItems(ProtocolVersionsKey, identification.ProtocolVersions.String()),
+		joinItems(ClientIdentificationSampleRateKey, strconv.Itoa(identification.AudioFormat.SampleRate)),
+		joinItems(ClientIdentificationChannelsKey, strconv.Itoa(identification.AudioFormat.Channels)),
+	}
+	if identification.FECGroupSize > 0 {
+		parts = append(parts, joinItems(ClientIdentificationFECKey, strconv.Itoa(identification.FECGroupSize)))
+	}
+	if len(identification.PublicKey) > 0 {
+		parts = append(parts, joinItems(ClientIdentificationPublicKeyKey, encodeBytes(identification.PublicKey)))
+	}
+	if len(identification.AuthSignature) > 0 {
+		parts = append(
+			parts,
+			joinItems(ClientIdentificationChallengeKey, encodeBytes(identification.AuthChallenge)),
+			joinItems(ClientIdentificationAuthKey, encodeBytes(identification.AuthSignature)),
+		)
+	}
+
+	return []byte(joinParts(parts...))
+}
+
+// CraftAuthChallenge puts together the server's challenge for a client to authenticate
+func CraftAuthChallenge(challenge []byte) []byte {
+	return []byte(joinParts(
+		ClientAuthChallengeKeyword,
+		joinItems(ClientIdentificationChallengeKey, encodeBytes(challenge)),
 	))
 }
 
+// ReadAuthChallenge reads the server's auth challenge and returns a boolean
+// flag if this was indeed a challenge message
+func ReadAuthChallenge(message string) (bool, []byte, error) {
+	parts := strings.Split(message, ServerMessagePartsDelimiter)
+	if parts[0] != ClientAuthChallengeKeyword {
+		return false, nil, nil
+	}
+
+	challenge, err := decodeBytes(readItems(parts[1:])[ClientIdentificationChallengeKey])
+	if err != nil {
+		return true, nil, err
+	}
+	if len(challenge) == 0 {
+		return true, nil, errors.New("challenge not provided")
+	}
+
+	return true, challenge, nil
+}
+
 // CraftClientIdentificationResponse puts together a client identification response message
-func CraftClientIdentificationResponse(ok bool, sessionToken string) []byte {
-	return []byte(
-		joinParts(
-			ClientIdentificationResponse,
-			fmt.Sprintf("%t", ok),
-			sessionToken,
-		),
-	)
+func CraftClientIdentificationResponse(result IdentificationResult) []byte {
+	parts := []string{
+		ClientIdentificationResponse,
+		fmt.Sprintf("%t", result.OK),
+	}
+	if result.OK {
+		parts = append(
+			parts,
+			joinItems(ClientIdentificationSessionIDKey, strconv.FormatUint(uint64(result.SessionID), 10)),
+			joinItems(ClientIdentificationPayloadFormatKey, strconv.Itoa(int(result.PayloadFormat))),
+		)
+	}
+	if result.SessionToken != "" {
+		parts = append(parts, joinItems(ClientIdentificationSessionTokenKey, result.SessionToken))
+	}
+	if result.FECGroupSize > 0 {
+		parts = append(parts, joinItems(ClientIdentificationFECKey, strconv.Itoa(result.FECGroupSize)))
+	}
+	if len(result.PublicKey) > 0 {
+		parts = append(
+			parts,
+			joinItems(ClientIdentificationPublicKeyKey, encodeBytes(result.PublicKey)),
+			joinItems(ClientIdentificationKeyConfirmationKey, encodeBytes(result.KeyConfirmation)),
+		)
+	}
+	if result.ProtocolVersion > 0 {
+		parts = append(parts, joinItems(ProtocolVersionKey, strconv.Itoa(result.ProtocolVersion)))
+	}
+	if result.ProtocolVersions.Max > 0 {
+		parts = append(parts, joinItems(ProtocolVersionsKey, result.ProtocolVersions.String()))
+	}
+	if result.Reason != "" {
+		parts = append(parts, joinItems(ClientIdentificationReasonKey, string(result.Reason)))
+	}
+
+	return []byte(joinParts(parts...))
 }
 
 // ReadClientIdentificationMessage reads a client identification message and
 // returns the individual parts, and a boolean flag if this was indeed a client identification message
-func ReadClientIdentificationMessage(message string) (bool, string, []int, error) {
+func ReadClientIdentificationMessage(message string) (bool, ClientIdentification, error) {
 	parts := strings.Split(message, ServerMessagePartsDelimiter)
-	if len(parts) != 3 {
-		return false, "", nil, nil
-	}
-
 	if parts[0] != ClientIdentificationKeyword {
-		return false, "", nil, nil
+		return false, ClientIdentification{}, nil
 	}
+	items := readItems(parts[1:])
 
-	nameIdentificationParts := strings.Split(parts[1], ServerMessageItemDelimiter)
-	if len(nameIdentificationParts) != 2 ||
-		nameIdentificationParts[0] != ClientIdentificationNameKey {
-		return true, "", nil, errors.New("client name not provided")
+	name, ok := items[ClientIdentificationNameKey]
+	if !ok {
+		return true, ClientIdentification{}, errors.New("client name not provided")
 	}
-	name := nameIdentificationParts[1]
 
-	capabilitiesParts := strings.Split(parts[2], ServerMessageItemDelimiter)
-	if len(capabilitiesParts) != 2 ||
-		capabilitiesParts[0] != ClientIdentificationCapabilitiesKey {
-		return true, "", nil, errors.New("client capabilities not provided")
+	capabilitiesStr, ok := items[ClientIdentificationCapabilitiesKey]
+	if !ok {
+		return true, ClientIdentification{}, errors.New("client capabilities not provided")
 	}
-	capabilities := Map(strings.Split(capabilitiesParts[1], ","), func(capabilityStr string) int {
-		// ehhh it'll be easy to figure out if the capability isn't being sent correctly
-		i, _ := strconv.Atoi(capabilityStr)
-		return i
+	capabilities := Map(splitInts(capabilitiesStr), func(capability int) ClientCapability {
+		return ClientCapability(capability)
 	})
-	capabilities = FilterSlice(capabilities, func(capability int) bool { return capability > 0 })
 
-	return true, name, capabilities, nil
+	// Clients from before codecs existed only know how to send float32
+	payloadFormats := []PayloadFormat{PayloadFormatFloat32}
+	if payloadFormatsStr, ok := items[ClientIdentificationPayloadFormatsKey]; ok {
+		payloadFormats = Map(splitInts(payloadFormatsStr), func(format int) PayloadFormat {
+			return PayloadFormat(format)
+		})
+	}
+
+	publicKey, err := decodeBytes(items[ClientIdentificationPublicKeyKey])
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+	authChallenge, err := decodeBytes(items[ClientIdentificationChallengeKey])
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+	authSignature, err := decodeBytes(items[ClientIdentificationAuthKey])
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+	protocolVersions, err := readProtocolVersions(items)
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+	audioFormat, err := readAudioFormat(items)
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+	fecGroupSize, err := readFECGroupSize(items)
+	if err != nil {
+		return true, ClientIdentification{}, err
+	}
+
+	return true, ClientIdentification{
+		Name:             name,
+		Capabilities:     capabilities,
+		PayloadFormats:   payloadFormats,
+		PublicKey:        publicKey,
+		AuthChallenge:    authChallenge,
+		AuthSignature:    authSignature,
+		ProtocolVersions: protocolVersions,
+		AudioFormat:      audioFormat,
+		FECGroupSize:     fecGroupSize,
+	}, nil
 }
 
-// ReadClientIdentificationResponse returns whether the connection was ok
-// based on the server response
-func ReadClientIdentificationResponse(message string) (bool, string, error) {
+// readFECGroupSize reads how many packets go in each FEC group.
+// It's 0, no FEC, when whoever sent it didn't mention it
+func readFECGroupSize(items map[string]string) (int, error) {
+	groupSize, ok := items[ClientIdentificationFECKey]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(groupSize)
+}
+
+// readAudioFormat reads the format of a client's audio. Clients from
+// before they could pick one are in the mix format
+func readAudioFormat(items map[string]string) (AudioFormat, error) {
+	format := MixFormat
+	if sampleRate, ok := items[ClientIdentificationSampleRateKey]; ok {
+		var err error
+		format.SampleRate, err = strconv.Atoi(sampleRate)
+		if err != nil {
+			return AudioFormat{}, err
+		}
+	}
+	if channels, ok := items[ClientIdentificationChannelsKey]; ok {
+		var err error
+		format.Channels, err = strconv.Atoi(channels)
+		if err != nil {
+			return AudioFormat{}, err
+		}
+	}
+
+	return format, nil
+}
+
+// ReadClientIdentificationResponse reads the server's response to our
+// identification message
+func ReadClientIdentificationResponse(message string) (IdentificationResult, error) {
 	parts := strings.Split(message, ServerMessagePartsDelimiter)
-	if len(parts) != 3 || parts[0] != ClientIdentificationResponse {
-		return false, "", ErrNotClientIdentificationMessage
+	if len(parts) < 2 || parts[0] != ClientIdentificationResponse {
+		return IdentificationResult{}, ErrNotClientIdentificationMessage
 	}
 
 	ok, err := strconv.ParseBool(parts[1])
 	if err != nil {
-		return false, "", err
+		return IdentificationResult{}, err
 	}
+	items := readItems(parts[2:])
 
-	return ok, parts[2], nil
-}
+	protocolVersions, err := readProtocolVersions(items)
+	if err != nil {
+		return IdentificationResult{}, err
+	}
 
-// CreateClientBytesRequest creates a client bytes request
-func CreateClientBytesRequest(sessionToken string, audio []byte) []byte {
-	header := []byte(joinParts(ClientAudioBytes, sessionToken) + ";")
-	return append(header, audio...)
-}
+	result := IdentificationResult{
+		OK:               ok,
+		SessionToken:     items[ClientIdentificationSessionTokenKey],
+		PayloadFormat:    PayloadFormatFloat32,
+		Reason:           RejectionReason(items[ClientIdentificationReasonKey]),
+		ProtocolVersions: protocolVersions,
+		ProtocolVersion:  protocolVersions.Max,
+	}
+	if !ok {
+		return result, nil
+	}
 
-// ReadClientBytesRequest reads in a clients bytes request
-func ReadClientBytesRequest(message string) (bool, string, error) {
-	parts := strings.Split(message, ServerMessagePartsDelimiter)
-	if len(parts) != 3 || parts[0] != ClientAudioBytes {
-		fmt.Printf("%s not okay, len %d and first thing is %s\n", message, len(parts), parts[0])
-		return false, "", nil
+	if versionStr, ok := items[ProtocolVersionKey]; ok {
+		result.ProtocolVersion, err = strconv.Atoi(versionStr)
+		if err != nil {
+			return IdentificationResult{}, err
+		}
+	}
+
+	sessionID, err := strconv.ParseUint(items[ClientIdentificationSessionIDKey], 10, 32)
+	if err != nil {
+		return IdentificationResult{}, err
+	}
+	result.SessionID = uint32(sessionID)
+
+	if payloadFormatStr, ok := items[ClientIdentificationPayloadFormatKey]; ok {
+		payloadFormat, err := strconv.Atoi(payloadFormatStr)
+		if err != nil {
+			return IdentificationResult{}, err
+		}
+		result.PayloadFormat = PayloadFormat(payloadFormat)
+	}
+
+	result.FECGroupSize, err = readFECGroupSize(items)
+	if err != nil {
+		return IdentificationResult{}, err
+	}
+
+	result.PublicKey, err = decodeBytes(items[ClientIdentificationPublicKeyKey])
+	if err != nil {
+		return IdentificationResult{}, err
+	}
+	result.KeyConfirmation, err = decodeBytes(items[ClientIdentificationKeyConfirmationKey])
+	if err != nil {
+		return IdentificationResult{}, err
 	}
 
-	return true, parts[1], nil
+	return result, nil
 }
 
 func joinParts(parts ...string) string {
@@ -195,6 +442,49 @@ func joinItems(items ...string) string {
 	return strings.Join(items, ServerMessageItemDelimiter)
 }
 
+// readItems reads key/value items out of message parts. Only the first
+// delimiter splits the key from the value, so values can contain it
+func readItems(parts []string) map[string]string {
+	items := make(map[string]string, len(parts))
+	for _, part := range parts {
+		key, value, found := strings.Cut(part, ServerMessageItemDelimiter)
+		if !found {
+			continue
+		}
+		items[key] = value
+	}
+
+	return items
+}
+
+func encodeBytes(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// decodeBytes decodes bytes encoded with encodeBytes. Empty strings
+// decode to nil
+func decodeBytes(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+func joinInts(ints []int) string {
+	return strings.Join(Map(ints, strconv.Itoa), ",")
+}
+
+// splitInts reads a comma separated list of positive ints, skipping
+// anything that isn't one
+func splitInts(s string) []int {
+	ints := Map(strings.Split(s, ","), func(intStr string) int {
+		// ehhh it'll be easy to figure out if something isn't being sent correctly
+		i, _ := strconv.Atoi(intStr)
+		return i
+	})
+	return FilterSlice(ints, func(i int) bool { return i > 0 })
+}
+
 // FilterSlice filters items out of a slice
 func FilterSlice[T any](s []T, f func(T) bool) []T {
 	var out []T
@@ -230,3 +520,21 @@ func ClampFloat(in float32, boundaries ...float32) float32 {
 
 	return in
 }
+
+// BytesToFloats converts a byte slice to a float32 slice without copying.
+func BytesToFloats(b []byte) []float32 {
+	if len(b) == 0 {
+		return nil
+	}
+	// Divide length by 4 because float32 is 4 bytes
+	return unsafe.Slice((*float32)(unsafe.Pointer(&b[0])), len(b)/4)
+}
+
+// FloatsToBytes converts a float32 slice to a byte slice without copying.
+func FloatsToBytes(f []float32) []byte {
+	if len(f) == 0 {
+		return nil
+	}
+	// Multiply length by 4 because each float32 is 4 bytes
+	return unsafe.Slice((*byte)(unsafe.Pointer(&f[0])), len(f)*4)
+}
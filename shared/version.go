@@ -0,0 +1,69 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersionRange is the range of protocol versions a peer speaks
+type ProtocolVersionRange struct {
+	Min int
+	Max int
+}
+
+// SupportedProtocolVersions are the protocol versions we speak
+var SupportedProtocolVersions = ProtocolVersionRange{
+	Min: MinProtocolVersion,
+	Max: MaxProtocolVersion,
+}
+
+// LegacyProtocolVersions is what peers from before version negotiation speak
+var LegacyProtocolVersions = ProtocolVersionRange{Min: 1, Max: 1}
+
+func (versions ProtocolVersionRange) String() string {
+	return fmt.Sprintf("%d-%d", versions.Min, versions.Max)
+}
+
+// Contains tells you if version is in the range
+func (versions ProtocolVersionRange) Contains(version int) bool {
+	return version >= versions.Min && version <= versions.Max
+}
+
+// PickProtocolVersion picks the highest protocol version both ranges have.
+// It returns false if they don't overlap
+func PickProtocolVersion(ours, theirs ProtocolVersionRange) (int, bool) {
+	version := min(ours.Max, theirs.Max)
+	if version < max(ours.Min, theirs.Min) {
+		return 0, false
+	}
+
+	return version, true
+}
+
+// readProtocolVersions reads a version range item. Peers that don't send one
+// are from before version negotiation
+func readProtocolVersions(items map[string]string) (ProtocolVersionRange, error) {
+	versionsStr, ok := items[ProtocolVersionsKey]
+	if !ok {
+		return LegacyProtocolVersions, nil
+	}
+
+	minStr, maxStr, found := strings.Cut(versionsStr, "-")
+	if !found {
+		return ProtocolVersionRange{}, fmt.Errorf("malformed protocol versions %q", versionsStr)
+	}
+	minVersion, err := strconv.Atoi(minStr)
+	if err != nil {
+		return ProtocolVersionRange{}, err
+	}
+	maxVersion, err := strconv.Atoi(maxStr)
+	if err != nil {
+		return ProtocolVersionRange{}, err
+	}
+	if minVersion > maxVersion {
+		return ProtocolVersionRange{}, fmt.Errorf("malformed protocol versions %q", versionsStr)
+	}
+
+	return ProtocolVersionRange{Min: minVersion, Max: maxVersion}, nil
+}